@@ -1,64 +1,185 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
 	"fmt"
 	"github.com/tomdim/bookings/internal/config"
 	"github.com/tomdim/bookings/internal/driver"
 	"github.com/tomdim/bookings/internal/handlers"
 	"github.com/tomdim/bookings/internal/helpers"
+	"github.com/tomdim/bookings/internal/logging"
+	"github.com/tomdim/bookings/internal/mailer"
+	"github.com/tomdim/bookings/internal/metrics"
 	"github.com/tomdim/bookings/internal/models"
 	"github.com/tomdim/bookings/internal/render"
-	"log"
+	"github.com/tomdim/bookings/internal/tracing"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/alexedwards/scs/v2"
+	"github.com/alexedwards/scs/v2/memstore"
 )
 
-const portNumber = ":8889"
-
 var app config.AppConfig
 var session *scs.SessionManager
-var infoLog *log.Logger
-var errorLog *log.Logger
+var logger = logging.New(os.Stdout, slog.LevelInfo)
+
+// mailQueueSize is the number of mails that can wait to be sent before new ones are dropped
+const mailQueueSize = 100
 
 // main is the main entrypoint
 func main() {
-	db, err := run()
+	settings, err := config.LoadSettings(os.Args[1:], os.Getenv)
 	if err != nil {
-		log.Fatal(err)
+		fatal("cannot load settings", err)
 	}
-	defer db.SQL.Close()
 
-	fmt.Printf("Starting application on port %s\n", portNumber)
+	flushTraces, err := tracing.Setup(context.Background(), settings.Tracing, os.Stdout)
+	if err != nil {
+		fatal("cannot set up tracing", err)
+	}
+
+	db, err := run(settings)
+	if err != nil {
+		fatal("cannot start application", err)
+	}
+
+	stopMailer := startMailer(settings.Mail)
+
+	logger.Info("starting application", "port", settings.Port, "tls", settings.TLS.Enabled())
 
 	srv := &http.Server{
-		Addr:    portNumber,
+		Addr:    settings.Addr(),
 		Handler: routes(&app),
 	}
 
-	err = srv.ListenAndServe()
-	log.Fatal(err)
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		fatal("cannot listen", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = serve(ctx, srv, ln, settings.TLS, settings.DrainTimeout)
+	if err != nil {
+		logger.Error("server stopped", "error", err)
+	}
+
+	shutdown(db, flushTraces, stopMailer)
+	if err != nil {
+		// exit non-zero, so that the server gets restarted
+		os.Exit(1)
+	}
+}
+
+// fatal logs an error that prevents the application from running and exits
+func fatal(msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
 }
 
-func run() (*driver.DB, error) {
+// serve runs the server on ln, over https when tls is enabled, until it fails or ctx is done,
+// then waits up to drainTimeout for in-flight requests to complete
+func serve(ctx context.Context, srv *http.Server, ln net.Listener, tls config.TLSSettings, drainTimeout time.Duration) error {
+	serverErrors := make(chan error, 1)
+	go func() {
+		if tls.Enabled() {
+			serverErrors <- srv.ServeTLS(ln, tls.CertFile, tls.KeyFile)
+			return
+		}
+		serverErrors <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-serverErrors:
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.Info("shutting down, draining connections", "drain_timeout", drainTimeout.String())
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	err := srv.Shutdown(drainCtx)
+	if err != nil {
+		// the drain timed out, so drop the remaining connections
+		srv.Close()
+		return fmt.Errorf("cannot drain connections: %w", err)
+	}
+
+	return nil
+}
+
+// startMailer sends the mails queued on app.MailChan in the background, through the SMTP server
+// when one is configured. The returned func stops it once the queued mails are sent.
+func startMailer(settings config.MailSettings) func() {
+	var sender mailer.Sender = mailer.Log{Logger: logger}
+	if settings.Host != "" {
+		sender = mailer.SMTP{
+			Host:     settings.Host,
+			Port:     settings.Port,
+			Username: settings.Username,
+			Password: settings.Password,
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := mailer.Listen(ctx, app.MailChan, sender, logger)
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// shutdown stops the background workers, flushes the pending spans and releases the resources
+// held by the application
+func shutdown(db *driver.DB, flushTraces func(context.Context) error, stopMailer func()) {
+	if store, ok := session.Store.(*memstore.MemStore); ok {
+		store.StopCleanup()
+	}
+	stopMailer()
+
+	err := db.SQL.Close()
+	if err != nil {
+		logger.Error("cannot close database pool", "error", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = flushTraces(ctx)
+	if err != nil {
+		logger.Error("cannot flush traces", "error", err)
+	}
+
+	logger.Info("shutdown complete")
+}
+
+func run(settings config.Settings) (*driver.DB, error) {
 	// what am I going to put in the session
 	gob.Register(models.Reservation{})
 	gob.Register(models.User{})
 	gob.Register(models.Room{})
 	gob.Register(models.Restriction{})
 	gob.Register(models.RoomRestriction{})
+	gob.Register(map[string]int{})
 
-	// Change this to true when in production
-	app.InProduction = false
+	app.InProduction = settings.InProduction
+	app.HTTPSRedirect = settings.HTTPSRedirect
+	app.TrustedProxyHeader = settings.TrustedProxyHeader
+	app.TrustedIPHeader = settings.TrustedIPHeader
 
-	infoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
-	app.InfoLog = infoLog
-
-	errorLog = log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
-	app.ErrorLog = errorLog
+	app.Logger = logger
+	// lines written by libraries through the log package are logged as json too
+	slog.SetDefault(logger)
 
 	session = scs.New()
 	session.Lifetime = 24 * time.Hour
@@ -68,22 +189,35 @@ func run() (*driver.DB, error) {
 
 	app.Session = session
 
+	app.DBQueryTimeout = settings.DBQueryTimeout
+	app.CancelDeadline = settings.CancelDeadline
+	app.RateLimit = settings.RateLimit
+
+	app.MailChan = make(chan models.MailData, mailQueueSize)
+	app.MailFrom = settings.Mail.From
+	app.MailOwner = settings.Mail.Owner
+
 	// connect to DB
-	log.Println("Connecting to DB...")
-	db, err := driver.ConnectSQL("host=localhost port=5432 dbname=bookings user=orfium password=1234")
+	logger.Info("connecting to database", "host", settings.Database.Host, "name", settings.Database.Name)
+	db, err := driver.ConnectSQL(settings.Database.DSN())
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to database %s on %s:%d: %w",
+			settings.Database.Name, settings.Database.Host, settings.Database.Port, err)
+	}
+	logger.Info("connected to database")
+
+	err = metrics.RegisterDB(db.SQL)
 	if err != nil {
-		log.Fatal("Cannot connect to databse! Dying...")
+		return nil, fmt.Errorf("cannot register database metrics: %w", err)
 	}
-	log.Println("Connected to DB!")
 
 	tc, err := render.CreateTemplateCache()
 	if err != nil {
-		log.Fatal("cannot create template cache")
-		return nil, err
+		return nil, fmt.Errorf("cannot create template cache: %w", err)
 	}
 
 	app.TemplateCache = tc
-	app.UseCache = false
+	app.UseCache = settings.UseCache
 
 	repo := handlers.NewRepo(&app, db)
 	handlers.NewHandlers(repo)
@@ -1,10 +1,180 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/tomdim/bookings/internal/config"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
 
 func TestRun(t *testing.T) {
-	_, err := run()
+	_, err := run(config.DefaultSettings())
 	if err != nil {
 		t.Error("failed run()")
 	}
 }
+
+func TestServe(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, srv, ln, config.TLSSettings{}, time.Second)
+	}()
+
+	// the in-flight request completes even though shutdown starts while it is handled
+	responses := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			responses <- 0
+			return
+		}
+		resp.Body.Close()
+		responses <- resp.StatusCode
+	}()
+
+	<-started
+	cancel()
+
+	if code := <-responses; code != http.StatusOK {
+		t.Errorf("in-flight request was not drained: got status %d", code)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve returned unexpected error on shutdown: %s", err)
+	}
+}
+
+func TestServe_TLS(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS == nil {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, srv, ln, selfSignedCert(t), time.Second)
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	resp, err := client.Get("https://" + ln.Addr().String())
+	if err != nil {
+		t.Fatalf("cannot request the server over https: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("request was not served over tls: got status %d", resp.StatusCode)
+	}
+
+	cancel()
+	if err := <-served; err != nil {
+		t.Errorf("serve returned unexpected error on shutdown: %s", err)
+	}
+}
+
+func TestServe_Errors(t *testing.T) {
+	dir := t.TempDir()
+	missingCert := config.TLSSettings{
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+	}
+
+	var serveErrorTests = []struct {
+		name   string
+		tls    config.TLSSettings
+		closed bool
+	}{
+		{"missing tls certificate", missingCert, false},
+		{"closed listener", config.TLSSettings{}, true},
+	}
+
+	for _, e := range serveErrorTests {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.closed {
+			ln.Close()
+		}
+
+		err = serve(context.Background(), &http.Server{}, ln, e.tls, time.Second)
+		if err == nil {
+			t.Errorf("%s: expected serve to return the error", e.name)
+		}
+		ln.Close()
+	}
+}
+
+// selfSignedCert writes a certificate and key for localhost to a temporary directory
+func selfSignedCert(t *testing.T) config.TLSSettings {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	settings := config.TLSSettings{
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+	}
+	err = os.WriteFile(settings.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(settings.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return settings
+}
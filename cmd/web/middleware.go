@@ -1,11 +1,47 @@
 package main
 
 import (
+	"context"
+	"github.com/tomdim/bookings/internal/handlers"
+	"github.com/tomdim/bookings/internal/helpers"
+	"github.com/tomdim/bookings/internal/logging"
+	"github.com/tomdim/bookings/internal/metrics"
+	"github.com/tomdim/bookings/internal/ratelimit"
+	"math"
+	"net"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/justinas/nosurf"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// validRequestID matches the incoming request ids that are safe to reuse in logs and headers
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// contentSecurityPolicy only lets the pages load scripts and styles from the site and the cdns
+// the layouts use. The templates have inline scripts and styles, so those are allowed too.
+const contentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self' 'unsafe-inline' https://cdn.jsdelivr.net https://unpkg.com; " +
+	"style-src 'self' 'unsafe-inline' https://cdn.jsdelivr.net https://unpkg.com; " +
+	"img-src 'self' data:; connect-src 'self'; " +
+	"frame-ancestors 'none'; base-uri 'self'; form-action 'self'"
+
+// probePaths are polled over plain http by the orchestrator, so they are never redirected to https
+var probePaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
 // NoSurf adds CSRF protection to all POST requests
 func NoSurf(next http.Handler) http.Handler {
 	csrfHandler := nosurf.New(next)
@@ -24,3 +60,274 @@ func NoSurf(next http.Handler) http.Handler {
 func SessionLoad(next http.Handler) http.Handler {
 	return session.LoadAndSave(next)
 }
+
+// Auth redirects users that are not logged in to the login page
+func Auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !helpers.IsAuthenticated(r) {
+			session.Put(r.Context(), "error", "Log in first!")
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireLevel only lets through logged in users having at least the given access level
+func RequireLevel(level int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return Auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userLevel, err := handlers.Repo.AccessLevel(r)
+			if err != nil {
+				helpers.ServerError(w, r, err)
+				return
+			}
+			if userLevel < level {
+				handlers.Repo.Forbidden(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}))
+	}
+}
+
+// APIAuth only lets through api requests sent with a valid bearer token, and adds the token to
+// the request context
+func APIAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := handlers.Repo.APIAuthenticate(w, r)
+		if !ok {
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(helpers.WithAPIToken(r.Context(), token)))
+	})
+}
+
+// RequireScope only lets through api requests whose token was granted the scope
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, _ := helpers.APIToken(r)
+			if !token.HasScope(scope) {
+				handlers.Repo.APIForbidden(w, r, scope)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// SecureHeaders sets the headers hardening the responses in production. HSTS is only sent over
+// https, as seen by the server or reported by the proxy in trustedProxyHeader.
+func SecureHeaders(trustedProxyHeader string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			h.Set("Content-Security-Policy", contentSecurityPolicy)
+			h.Set("X-Frame-Options", "DENY")
+			h.Set("X-Content-Type-Options", "nosniff")
+			h.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+			if isHTTPS(r, trustedProxyHeader) {
+				h.Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// HTTPSRedirect permanently redirects the requests made over plain http to https, except for
+// the health probes
+func HTTPSRedirect(trustedProxyHeader string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isHTTPS(r, trustedProxyHeader) || probePaths[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			// 308 keeps the method and body of posted forms
+			http.Redirect(w, r, "https://"+r.Host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+		})
+	}
+}
+
+// isHTTPS reports whether the request was made over https, either to the server itself or to
+// the proxy in front of it. trustedProxyHeader is only honoured when it is configured, as
+// clients could set it themselves otherwise.
+func isHTTPS(r *http.Request, trustedProxyHeader string) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return trustedProxyHeader != "" && strings.EqualFold(r.Header.Get(trustedProxyHeader), "https")
+}
+
+// RateLimit rejects the requests over the rate of limiter with a 429 response written by respond,
+// telling the client when to retry. Requests are counted per key, and name labels the rejections
+// in the metrics.
+func RateLimit(name string, limiter *ratelimit.Limiter, key func(r *http.Request) string, respond http.HandlerFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ok, retryAfter := limiter.Allow(key(r))
+			if !ok {
+				metrics.RateLimited.WithLabelValues(name).Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(retryAfter.Seconds())))))
+				respond(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// clientIPKey returns the rate limit key of the ip the request comes from, read from
+// trustedIPHeader when it is configured
+func clientIPKey(trustedIPHeader string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return clientIP(r, trustedIPHeader)
+	}
+}
+
+// clientIP returns the ip the request comes from. Behind a proxy every request comes from the
+// proxy, so the ip the proxy reports in trustedIPHeader is used instead when it is configured.
+// The proxy appends the ip it was connected from to the ones the client may have sent, so only
+// the last one is trusted.
+func clientIP(r *http.Request, trustedIPHeader string) string {
+	if trustedIPHeader != "" {
+		values := r.Header.Values(trustedIPHeader)
+		if len(values) > 0 {
+			ips := strings.Split(values[len(values)-1], ",")
+			ip := strings.TrimSpace(ips[len(ips)-1])
+			if net.ParseIP(ip) != nil {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// apiTokenKey is the rate limit key of the api token the request was authenticated with
+func apiTokenKey(r *http.Request) string {
+	token, _ := helpers.APIToken(r)
+	return strconv.Itoa(token.ID)
+}
+
+// RequestID tags the request context and the response with a request id, reusing the
+// X-Request-Id header sent by a proxy when there is one
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if !validRequestID.MatchString(id) {
+			id = logging.NewRequestID()
+		}
+		w.Header().Set("X-Request-Id", id)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+	})
+}
+
+// AccessLog logs every request with its response status and latency, along with the attributes
+// added further down the chain with addAccessLogAttrs. It is mounted outside the recoverer, so
+// that panicking requests are logged with their 500 too.
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		attrs := new([]any)
+
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), accessLogAttrsKey{}, attrs)))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		args := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", status,
+			"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+		}
+		app.Logger.InfoContext(r.Context(), "request", append(args, *attrs...)...)
+	})
+}
+
+// accessLogAttrsKey is the context key of the attributes added to the access log line of a request
+type accessLogAttrsKey struct{}
+
+// addAccessLogAttrs adds attributes to the access log line of the request
+func addAccessLogAttrs(r *http.Request, attrs ...any) {
+	if p, ok := r.Context().Value(accessLogAttrsKey{}).(*[]any); ok {
+		*p = append(*p, attrs...)
+	}
+}
+
+// LogUser adds the logged in user to the access log line of the request. It needs the session,
+// which the access log is mounted outside of.
+func LogUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		addAccessLogAttrs(r, "user_id", session.GetInt(r.Context(), "user_id"))
+	})
+}
+
+// Metrics counts and times the requests by chi route pattern, so that path parameters
+// do not create a time series per url. Like the access log, it is mounted outside the recoverer,
+// so that panicking requests are counted with their 500.
+func Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		metrics.HTTPRequests.WithLabelValues(r.Method, route, strconv.Itoa(status)).Inc()
+		metrics.HTTPDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// Tracing starts a server span for every request, continuing the trace of an incoming traceparent
+// header, and names it after the chi route pattern once the request has been routed
+func Tracing(next http.Handler) http.Handler {
+	tracer := otel.Tracer("github.com/tomdim/bookings/cmd/web")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("request_id", logging.RequestID(ctx)),
+			),
+		)
+		defer span.End()
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+
+		if rctx := chi.RouteContext(ctx); rctx != nil && rctx.RoutePattern() != "" {
+			span.SetName(r.Method + " " + rctx.RoutePattern())
+			span.SetAttributes(attribute.String("http.route", rctx.RoutePattern()))
+		}
+	})
+}
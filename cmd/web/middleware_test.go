@@ -1,9 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"github.com/tomdim/bookings/internal/handlers"
+	"github.com/tomdim/bookings/internal/helpers"
+	"github.com/tomdim/bookings/internal/logging"
+	"github.com/tomdim/bookings/internal/metrics"
+	"github.com/tomdim/bookings/internal/models"
+	"github.com/tomdim/bookings/internal/ratelimit"
+	"github.com/tomdim/bookings/internal/render"
+	"log/slog"
 	"net/http"
+	"net/http/httptest"
 	"testing"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func TestNoSurf(t *testing.T) {
@@ -27,3 +47,482 @@ func TestSessionLoad(t *testing.T) {
 		t.Error(fmt.Sprintf("type is not http.Handler, but is %T", v))
 	}
 }
+
+// setupSession sets up a new session manager, along with the handlers the auth middleware go
+// through
+func setupSession() {
+	session = scs.New()
+	app.Session = session
+	helpers.NewHelpers(&app)
+	render.NewRenderer(&app)
+	handlers.NewHandlers(handlers.NewTestRepo(&app))
+}
+
+// sessionCookie returns the cookie of a new session holding the given values
+func sessionCookie(t *testing.T, values map[string]int) *http.Cookie {
+	rr := httptest.NewRecorder()
+	session.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range values {
+			session.Put(r.Context(), k, v)
+		}
+	})).ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("expected a session cookie")
+	}
+	return cookies[0]
+}
+
+func TestAuth(t *testing.T) {
+	setupSession()
+
+	var myH myHandler
+	h := session.LoadAndSave(Auth(&myH))
+
+	// a logged in user is let through
+	req := httptest.NewRequest("GET", "/admin/dashboard", nil)
+	req.AddCookie(sessionCookie(t, map[string]int{"user_id": 1}))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected a logged in user to get %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	// an anonymous user is sent to log in
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/dashboard", nil))
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("expected an anonymous user to get %d, got %d", http.StatusSeeOther, rr.Code)
+	}
+	if loc := rr.Header().Get("Location"); loc != "/user/login" {
+		t.Errorf("expected a redirect to /user/login, got %s", loc)
+	}
+
+	// with the error shown on the login page
+	cookies := rr.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("expected the error to be saved in a session")
+	}
+	var msg string
+	req = httptest.NewRequest("GET", "/user/login", nil)
+	req.AddCookie(cookies[0])
+	session.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg = session.PopString(r.Context(), "error")
+	})).ServeHTTP(httptest.NewRecorder(), req)
+	if msg != "Log in first!" {
+		t.Errorf("expected the error %q, got %q", "Log in first!", msg)
+	}
+}
+
+var requireLevelTests = []struct {
+	name               string
+	session            map[string]int
+	expectedStatusCode int
+}{
+	{"anonymous", nil, http.StatusSeeOther},
+	{"owner", map[string]int{"user_id": 1, "access_level": models.AccessLevelOwner}, http.StatusOK},
+	{"staff", map[string]int{"user_id": 2, "access_level": models.AccessLevelStaff}, http.StatusForbidden},
+	// the level in the session is stale, the user was demoted since logging in
+	{"demoted to staff", map[string]int{"user_id": 2, "access_level": models.AccessLevelManager}, http.StatusForbidden},
+	{"deleted user", map[string]int{"user_id": 99, "access_level": models.AccessLevelOwner}, http.StatusForbidden},
+}
+
+func TestRequireLevel(t *testing.T) {
+	setupSession()
+
+	var myH myHandler
+	h := session.LoadAndSave(RequireLevel(models.AccessLevelManager)(&myH))
+
+	for _, e := range requireLevelTests {
+		req := httptest.NewRequest("GET", "/admin/rate-plans", nil)
+		if e.session != nil {
+			req.AddCookie(sessionCookie(t, e.session))
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: returned wrong response code: got %d, wanted %d", e.name, rr.Code, e.expectedStatusCode)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = logging.RequestID(r.Context())
+	}))
+
+	// a new id is generated when none is sent
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if seen == "" || rr.Header().Get("X-Request-Id") != seen {
+		t.Errorf("expected generated request id in context and header, got %q and %q", seen, rr.Header().Get("X-Request-Id"))
+	}
+
+	// a valid incoming id is reused
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-Id", "proxy-id-1")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if seen != "proxy-id-1" || rr.Header().Get("X-Request-Id") != "proxy-id-1" {
+		t.Errorf("expected incoming request id to be reused, got %q", seen)
+	}
+
+	// an invalid incoming id is replaced
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-Id", "bad id\nwith newline")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if seen == "bad id\nwith newline" {
+		t.Error("expected invalid incoming request id to be replaced")
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var myH myHandler
+	h := AccessLog(&myH)
+	switch v := h.(type) {
+	case http.Handler:
+		// do nothing
+	default:
+		t.Error(fmt.Sprintf("type is not http.Handler, but is %T", v))
+	}
+}
+
+func TestAccessLog_Panic(t *testing.T) {
+	var buf bytes.Buffer
+	appLogger := app.Logger
+	app.Logger = logging.New(&buf, slog.LevelInfo)
+	defer func() { app.Logger = appLogger }()
+
+	h := AccessLog(middleware.Recoverer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addAccessLogAttrs(r, "user_id", 7)
+		panic("boom")
+	})))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/about", nil))
+
+	var line struct {
+		Msg    string `json:"msg"`
+		Path   string `json:"path"`
+		Status int    `json:"status"`
+		UserID int    `json:"user_id"`
+	}
+	for _, l := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		if err := json.Unmarshal(l, &line); err == nil && line.Msg == "request" {
+			break
+		}
+	}
+	if line.Msg != "request" || line.Path != "/about" || line.Status != http.StatusInternalServerError || line.UserID != 7 {
+		t.Errorf("expected the panicking request to be logged with a 500 and its user, got %s", buf.String())
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	mux := chi.NewRouter()
+	mux.Use(Metrics)
+	mux.Get("/rooms/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	counter := metrics.HTTPRequests.WithLabelValues("GET", "/rooms/{id}", "404")
+	before := testutil.ToFloat64(counter)
+
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/rooms/1", nil))
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/rooms/2", nil))
+
+	// both urls are counted under the same route pattern
+	if got := testutil.ToFloat64(counter) - before; got != 2 {
+		t.Errorf("expected 2 requests counted for /rooms/{id}, got %v", got)
+	}
+
+	unmatched := metrics.HTTPRequests.WithLabelValues("GET", "unmatched", "404")
+	before = testutil.ToFloat64(unmatched)
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/no-such-page", nil))
+	if got := testutil.ToFloat64(unmatched) - before; got != 1 {
+		t.Errorf("expected unknown url to be counted as unmatched, got %v", got)
+	}
+}
+
+func TestMetrics_Panic(t *testing.T) {
+	mux := chi.NewRouter()
+	mux.Use(Metrics)
+	mux.Use(middleware.Recoverer)
+	mux.Get("/panic/{id}", func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+
+	counter := metrics.HTTPRequests.WithLabelValues("GET", "/panic/{id}", "500")
+	before := testutil.ToFloat64(counter)
+
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/panic/1", nil))
+
+	if got := testutil.ToFloat64(counter) - before; got != 1 {
+		t.Errorf("expected the panicking request to be counted with a 500, got %v", got)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	mux := chi.NewRouter()
+	mux.Use(Tracing)
+	mux.Get("/choose-room/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusSeeOther)
+	})
+
+	req := httptest.NewRequest("GET", "/choose-room/1", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "GET /choose-room/{id}" {
+		t.Errorf("expected span named after the route, got %s", span.Name())
+	}
+	if span.Parent().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected span to continue the incoming trace, got %s", span.Parent().TraceID())
+	}
+	found := false
+	for _, a := range span.Attributes() {
+		if a.Key == "http.response.status_code" && a.Value.AsInt64() == http.StatusSeeOther {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected status code attribute 303, got %v", span.Attributes())
+	}
+}
+
+func TestAPIAuth(t *testing.T) {
+	handlers.NewHandlers(handlers.NewTestRepo(&app))
+
+	var myH myHandler
+	h := APIAuth(RequireScope(models.ScopeWriteReservations)(&myH))
+
+	var tests = []struct {
+		name               string
+		token              string
+		expectedStatusCode int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"unknown token", "bk_nope", http.StatusUnauthorized},
+		{"missing scope", "bk_test_availability", http.StatusForbidden},
+		{"granted scope", "bk_test_reservations", http.StatusOK},
+	}
+
+	for _, e := range tests {
+		req := httptest.NewRequest("POST", "/api/v1/reservations", nil)
+		if e.token != "" {
+			req.Header.Set("Authorization", "Bearer "+e.token)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected %d, got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	var seen bool
+	h := RequireScope(models.ScopeReadAvailability)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = true
+	}))
+
+	req := httptest.NewRequest("GET", "/api/v1/rooms", nil)
+	req = req.WithContext(helpers.WithAPIToken(req.Context(), models.APIToken{
+		Scopes: []string{models.ScopeReadAvailability},
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if !seen {
+		t.Error("expected a token granted the scope to be let through")
+	}
+}
+
+var requireScopeTests = []struct {
+	name     string
+	scopes   []string
+	expected int
+}{
+	{"read scope", []string{models.ScopeReadReservations}, http.StatusOK},
+	{"implied by the write scope", []string{models.ScopeWriteReservations}, http.StatusOK},
+	{"other scope", []string{models.ScopeReadAvailability}, http.StatusForbidden},
+}
+
+func TestRequireScope_Reservations(t *testing.T) {
+	h := RequireScope(models.ScopeReadReservations)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, e := range requireScopeTests {
+		req := httptest.NewRequest("GET", "/api/v1/reservations/BK-TEST-0001", nil)
+		req = req.WithContext(helpers.WithAPIToken(req.Context(), models.APIToken{Scopes: e.scopes}))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != e.expected {
+			t.Errorf("%s: expected %d, got %d", e.name, e.expected, rr.Code)
+		}
+	}
+
+	// the write scope does not work the other way around
+	token := models.APIToken{Scopes: []string{models.ScopeReadReservations}}
+	if token.HasScope(models.ScopeWriteReservations) {
+		t.Error("expected the read scope not to grant writing")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	limiter := ratelimit.New(60, 2)
+	h := RateLimit("ip", limiter, clientIPKey(""), handlers.Repo.APITooManyRequests)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rejected := metrics.RateLimited.WithLabelValues("ip")
+	before := testutil.ToFloat64(rejected)
+
+	serve := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/search-availability-json", nil)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// the burst is let through, whatever port the client connects from
+	for _, addr := range []string{"10.0.0.1:1234", "10.0.0.1:5678"} {
+		if rr := serve(addr); rr.Code != http.StatusOK {
+			t.Fatalf("expected request within the burst to be let through, got %d", rr.Code)
+		}
+	}
+
+	rr := serve("10.0.0.1:1234")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected request over the burst to get 429, got %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("expected Retry-After of 1 second, got %q", rr.Header().Get("Retry-After"))
+	}
+	if got := testutil.ToFloat64(rejected) - before; got != 1 {
+		t.Errorf("expected 1 rejected request counted, got %v", got)
+	}
+
+	// other clients have their own bucket
+	if rr := serve("10.0.0.2:1234"); rr.Code != http.StatusOK {
+		t.Errorf("expected another client to be let through, got %d", rr.Code)
+	}
+}
+
+func TestRateLimit_Disabled(t *testing.T) {
+	h := RateLimit("ip", ratelimit.New(0, 0), clientIPKey(""), handlers.Repo.APITooManyRequests)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i := 0; i < 50; i++ {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("POST", "/make-reservation", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected a disabled rate limit to let every request through, got %d", rr.Code)
+		}
+	}
+}
+
+func TestSecureHeaders(t *testing.T) {
+	h := SecureHeaders("X-Forwarded-Proto")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	for _, header := range []string{"Content-Security-Policy", "X-Frame-Options", "X-Content-Type-Options", "Referrer-Policy"} {
+		if rr.Header().Get(header) == "" {
+			t.Errorf("expected the %s header to be set", header)
+		}
+	}
+	if rr.Header().Get("Strict-Transport-Security") != "" {
+		t.Error("expected no HSTS header over plain http")
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Header().Get("Strict-Transport-Security") == "" {
+		t.Error("expected the HSTS header over https reported by the proxy")
+	}
+}
+
+var httpsRedirectTests = []struct {
+	name             string
+	url              string
+	forwardedProto   string
+	expectedLocation string
+}{
+	{"plain http", "http://example.com/make-reservation?x=1", "", "https://example.com/make-reservation?x=1"},
+	{"https at the proxy", "http://example.com/make-reservation", "https", ""},
+	{"http at the proxy", "http://example.com/", "http", "https://example.com/"},
+	{"https at the server", "https://example.com/", "", ""},
+	{"health probe", "http://example.com/healthz", "", ""},
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	h := HTTPSRedirect("X-Forwarded-Proto")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, e := range httpsRedirectTests {
+		req := httptest.NewRequest("POST", e.url, nil)
+		if e.forwardedProto != "" {
+			req.Header.Set("X-Forwarded-Proto", e.forwardedProto)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if e.expectedLocation == "" {
+			if rr.Code != http.StatusOK {
+				t.Errorf("%s: expected the request to be let through, got %d", e.name, rr.Code)
+			}
+			continue
+		}
+		if rr.Code != http.StatusPermanentRedirect {
+			t.Errorf("%s: expected a permanent redirect, got %d", e.name, rr.Code)
+		}
+		if rr.Header().Get("Location") != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %s, got %s", e.name, e.expectedLocation, rr.Header().Get("Location"))
+		}
+	}
+}
+
+var clientIPTests = []struct {
+	name            string
+	trustedIPHeader string
+	forwardedFor    []string
+	expected        string
+}{
+	{"remote address", "", nil, "10.0.0.1"},
+	{"untrusted header", "", []string{"203.0.113.7"}, "10.0.0.1"},
+	{"trusted header", "X-Forwarded-For", []string{"203.0.113.7"}, "203.0.113.7"},
+	{"ips sent by the client", "X-Forwarded-For", []string{"198.51.100.1, 203.0.113.7"}, "203.0.113.7"},
+	{"several headers", "X-Forwarded-For", []string{"198.51.100.1", "203.0.113.7"}, "203.0.113.7"},
+	{"ipv6", "X-Forwarded-For", []string{"2001:db8::1"}, "2001:db8::1"},
+	{"invalid ip", "X-Forwarded-For", []string{"unknown"}, "10.0.0.1"},
+	{"missing header", "X-Forwarded-For", nil, "10.0.0.1"},
+}
+
+func TestClientIP(t *testing.T) {
+	for _, e := range clientIPTests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		for _, v := range e.forwardedFor {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+		if ip := clientIP(req, e.trustedIPHeader); ip != e.expected {
+			t.Errorf("%s: expected client ip %s, got %s", e.name, e.expected, ip)
+		}
+	}
+}
+
+func TestIsHTTPS_UntrustedHeader(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	if isHTTPS(req, "") {
+		t.Error("expected the forwarded scheme to be ignored when no proxy header is trusted")
+	}
+}
@@ -3,6 +3,10 @@ package main
 import (
 	"github.com/tomdim/bookings/internal/config"
 	"github.com/tomdim/bookings/internal/handlers"
+	"github.com/tomdim/bookings/internal/metrics"
+	"github.com/tomdim/bookings/internal/models"
+	"github.com/tomdim/bookings/internal/openapi"
+	"github.com/tomdim/bookings/internal/ratelimit"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -12,28 +16,128 @@ import (
 func routes(app *config.AppConfig) http.Handler {
 	mux := chi.NewRouter()
 
+	// searches and bookings hit the database, so they are rate limited per client ip, and the
+	// api per token. The availability json endpoint shares the bucket of the search form. Checking
+	// a token hits the database too, so api requests are also limited per client ip before it.
+	clientIP := clientIPKey(app.TrustedIPHeader)
+	ipLimiter := ratelimit.New(app.RateLimit.IPPerMinute, app.RateLimit.IPBurst)
+	apiIPLimiter := ratelimit.New(app.RateLimit.APIIPPerMinute, app.RateLimit.APIIPBurst)
+	apiLimiter := ratelimit.New(app.RateLimit.APIPerMinute, app.RateLimit.APIBurst)
+	limitIP := RateLimit("ip", ipLimiter, clientIP, handlers.Repo.TooManyRequests)
+	limitIPJSON := RateLimit("ip", ipLimiter, clientIP, handlers.Repo.JSONTooManyRequests)
+
+	mux.Use(RequestID)
+	mux.Use(Tracing)
+	mux.Use(AccessLog)
+	mux.Use(Metrics)
 	mux.Use(middleware.Recoverer)
-	mux.Use(NoSurf)
-	mux.Use(SessionLoad)
-
-	mux.Get("/", handlers.Repo.Home)
-	mux.Get("/about", handlers.Repo.About)
-	mux.Get("/contact", handlers.Repo.Contact)
-	mux.Get("/generals-quarters", handlers.Repo.Generals)
-	mux.Get("/majors-suite", handlers.Repo.Majors)
-
-	mux.Get("/search-availability", handlers.Repo.Availability)
-	mux.Post("/search-availability", handlers.Repo.PostAvailability)
-	mux.Post("/search-availability-json", handlers.Repo.AvailabilityJSON)
-	mux.Get("/choose-room/{id}", handlers.Repo.ChooseRoom)
-	mux.Get("/book-room", handlers.Repo.BookRoom)
-
-	mux.Get("/make-reservation", handlers.Repo.Reservation)
-	mux.Post("/make-reservation", handlers.Repo.PostReservation)
-	mux.Get("/reservation-summary", handlers.Repo.ReservationSummary)
-
-	fileServer := http.FileServer(http.Dir("./static/"))
-	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
+	if app.InProduction {
+		mux.Use(SecureHeaders(app.TrustedProxyHeader))
+		if app.HTTPSRedirect {
+			mux.Use(HTTPSRedirect(app.TrustedProxyHeader))
+		}
+	}
+
+	// probes are polled often, so they skip the session and csrf middleware
+	mux.Get("/healthz", handlers.Repo.Healthz)
+	mux.Get("/readyz", handlers.Repo.Readyz)
+	mux.Method("GET", "/metrics", metrics.Handler())
+	mux.Method("GET", "/api/openapi.json", openapi.Handler())
+
+	// the api is stateless json authenticated by bearer tokens, so it skips the session and
+	// csrf middleware
+	mux.Route("/api/v1", func(mux chi.Router) {
+		mux.Use(RateLimit("api_ip", apiIPLimiter, clientIP, handlers.Repo.APITooManyRequests))
+		mux.Use(APIAuth)
+		mux.Use(RateLimit("api", apiLimiter, apiTokenKey, handlers.Repo.APITooManyRequests))
+		mux.NotFound(handlers.Repo.APINotFound)
+		mux.MethodNotAllowed(handlers.Repo.APIMethodNotAllowed)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequireScope(models.ScopeReadAvailability))
+
+			mux.Get("/rooms", handlers.Repo.APIRooms)
+			mux.Get("/rooms/{id}", handlers.Repo.APIRoom)
+			mux.Get("/availability", handlers.Repo.APIAvailability)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequireScope(models.ScopeWriteReservations))
+
+			mux.Post("/reservations", handlers.Repo.APIPostReservation)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequireScope(models.ScopeReadReservations))
+
+			mux.Get("/reservations/{ref}", handlers.Repo.APIReservation)
+		})
+	})
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(SessionLoad)
+		mux.Use(LogUser)
+		mux.Use(NoSurf)
+
+		mux.Get("/", handlers.Repo.Home)
+		mux.Get("/about", handlers.Repo.About)
+		mux.Get("/contact", handlers.Repo.Contact)
+		mux.Get("/generals-quarters", handlers.Repo.Generals)
+		mux.Get("/majors-suite", handlers.Repo.Majors)
+
+		mux.Get("/search-availability", handlers.Repo.Availability)
+		mux.With(limitIP).Post("/search-availability", handlers.Repo.PostAvailability)
+		mux.With(limitIPJSON).Post("/search-availability-json", handlers.Repo.AvailabilityJSON)
+		mux.Get("/choose-room/{id}", handlers.Repo.ChooseRoom)
+		mux.Get("/book-room", handlers.Repo.BookRoom)
+
+		mux.Get("/make-reservation", handlers.Repo.Reservation)
+		mux.With(limitIP).Post("/make-reservation", handlers.Repo.PostReservation)
+		mux.Get("/reservation-summary", handlers.Repo.ReservationSummary)
+
+		// guests are looked up by reference and email, so the lookups are rate limited against guessing
+		mux.Get("/my-reservation", handlers.Repo.MyReservation)
+		mux.With(limitIP).Post("/my-reservation", handlers.Repo.PostMyReservation)
+		mux.With(limitIP).Post("/my-reservation/cancel", handlers.Repo.PostCancelMyReservation)
+
+		mux.Get("/user/login", handlers.Repo.ShowLogin)
+		mux.Post("/user/login", handlers.Repo.PostShowLogin)
+		mux.Get("/user/logout", handlers.Repo.Logout)
+
+		mux.Route("/admin", func(mux chi.Router) {
+			mux.Use(RequireLevel(models.AccessLevelStaff))
+
+			mux.Get("/dashboard", handlers.Repo.AdminDashboard)
+			mux.Get("/reservations-new", handlers.Repo.AdminNewReservations)
+			mux.Get("/reservations-all", handlers.Repo.AdminAllReservations)
+			mux.Get("/reservations-find", handlers.Repo.AdminFindReservation)
+			mux.Get("/reservations-calendar", handlers.Repo.AdminReservationsCalendar)
+			mux.Post("/reservations-calendar", handlers.Repo.AdminPostReservationsCalendar)
+			mux.Get("/reservations/{src}/{id}", handlers.Repo.AdminShowReservation)
+			mux.Post("/reservations/{src}/{id}", handlers.Repo.AdminPostShowReservation)
+			mux.Post("/reservations/{src}/{id}/delete", handlers.Repo.AdminDeleteReservation)
+			mux.Post("/reservations/{src}/{id}/processed", handlers.Repo.AdminProcessReservation)
+
+			mux.Group(func(mux chi.Router) {
+				mux.Use(RequireLevel(models.AccessLevelManager))
+
+				mux.Get("/rate-plans", handlers.Repo.AdminRatePlans)
+				mux.Post("/rate-plans", handlers.Repo.AdminPostRatePlans)
+				mux.Post("/rate-plans/{id}/delete", handlers.Repo.AdminDeleteRatePlan)
+			})
+
+			mux.Group(func(mux chi.Router) {
+				mux.Use(RequireLevel(models.AccessLevelOwner))
+
+				mux.Get("/api-tokens", handlers.Repo.AdminAPITokens)
+				mux.Post("/api-tokens", handlers.Repo.AdminPostAPITokens)
+				mux.Post("/api-tokens/{id}/delete", handlers.Repo.AdminDeleteAPIToken)
+			})
+		})
+
+		fileServer := http.FileServer(http.Dir("./static/"))
+		mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
+	})
 
 	return mux
 }
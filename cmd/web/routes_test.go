@@ -1,9 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/tomdim/bookings/internal/config"
+	"github.com/tomdim/bookings/internal/openapi"
+	"net/http"
+	"strings"
 	"testing"
 )
 
@@ -19,3 +23,34 @@ func TestRoutes(t *testing.T) {
 		t.Error(fmt.Sprintf("type is not chi.Mux, but is %T", v))
 	}
 }
+
+// jsonRoutes are the routes outside /api that answer with json and belong in the OpenAPI spec
+var jsonRoutes = map[string]bool{
+	"/search-availability-json": true,
+}
+
+func TestRoutes_OpenAPI(t *testing.T) {
+	var app config.AppConfig
+
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	err := json.Unmarshal(openapi.Spec, &doc)
+	if err != nil {
+		t.Fatalf("cannot parse the openapi spec: %s", err)
+	}
+
+	mux := routes(&app).(chi.Routes)
+	err = chi.Walk(mux, func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		if !strings.HasPrefix(route, "/api/") && !jsonRoutes[route] {
+			return nil
+		}
+		if _, ok := doc.Paths[route][strings.ToLower(method)]; !ok {
+			t.Errorf("route %s %s is missing from the openapi spec", method, route)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,18 +1,28 @@
 package config
 
 import (
+	"github.com/tomdim/bookings/internal/models"
 	"html/template"
-	"log"
+	"log/slog"
+	"time"
 
 	"github.com/alexedwards/scs/v2"
 )
 
 // AppConfig holds the application config
 type AppConfig struct {
-	UseCache      bool
-	TemplateCache map[string]*template.Template
-	InfoLog       *log.Logger
-	ErrorLog      *log.Logger
-	InProduction  bool
-	Session       *scs.SessionManager
+	UseCache           bool
+	TemplateCache      map[string]*template.Template
+	Logger             *slog.Logger
+	InProduction       bool
+	HTTPSRedirect      bool
+	TrustedProxyHeader string
+	TrustedIPHeader    string
+	Session            *scs.SessionManager
+	DBQueryTimeout     time.Duration
+	CancelDeadline     time.Duration
+	RateLimit          RateLimitSettings
+	MailChan           chan models.MailData
+	MailFrom           string
+	MailOwner          string
 }
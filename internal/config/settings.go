@@ -0,0 +1,398 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tomdim/bookings/internal/tracing"
+	"gopkg.in/yaml.v3"
+)
+
+// Settings holds the deployment settings the application is started with
+type Settings struct {
+	Port               int               `yaml:"port"`
+	InProduction       bool              `yaml:"in_production"`
+	UseCache           bool              `yaml:"use_cache"`
+	DBQueryTimeout     time.Duration     `yaml:"db_query_timeout"`
+	DrainTimeout       time.Duration     `yaml:"drain_timeout"`
+	CancelDeadline     time.Duration     `yaml:"cancel_deadline"`
+	Tracing            string            `yaml:"tracing"`
+	TLS                TLSSettings       `yaml:"tls"`
+	HTTPSRedirect      bool              `yaml:"https_redirect"`
+	TrustedProxyHeader string            `yaml:"trusted_proxy_header"`
+	TrustedIPHeader    string            `yaml:"trusted_ip_header"`
+	RateLimit          RateLimitSettings `yaml:"rate_limit"`
+	Mail               MailSettings      `yaml:"mail"`
+	Database           DatabaseSettings  `yaml:"database"`
+}
+
+// MailSettings holds the SMTP server the booking emails are sent through, and their addresses.
+// The emails are only logged when no SMTP host is set.
+type MailSettings struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+	Owner    string `yaml:"owner"`
+}
+
+// TLSSettings holds the certificate and key the server is served with over https. The server
+// is served over plain http, such as behind a proxy terminating tls, when they are not set.
+type TLSSettings struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// RateLimitSettings holds the rates of the token buckets limiting the availability searches and
+// bookings per client ip, the api requests per client ip before their token is checked, and the
+// api requests per api token. A rate of 0 disables the limit.
+type RateLimitSettings struct {
+	IPPerMinute    int `yaml:"ip_per_minute"`
+	IPBurst        int `yaml:"ip_burst"`
+	APIIPPerMinute int `yaml:"api_ip_per_minute"`
+	APIIPBurst     int `yaml:"api_ip_burst"`
+	APIPerMinute   int `yaml:"api_per_minute"`
+	APIBurst       int `yaml:"api_burst"`
+}
+
+// DatabaseSettings holds the settings used to connect to Postgres
+type DatabaseSettings struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Name     string `yaml:"name"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	SSLMode  string `yaml:"sslmode"`
+}
+
+// DefaultSettings returns the settings used for local development
+func DefaultSettings() Settings {
+	return Settings{
+		Port:           8889,
+		InProduction:   false,
+		UseCache:       false,
+		DBQueryTimeout: 3 * time.Second,
+		DrainTimeout:   15 * time.Second,
+		CancelDeadline: 48 * time.Hour,
+		RateLimit: RateLimitSettings{
+			IPPerMinute:    30,
+			IPBurst:        10,
+			APIIPPerMinute: 600,
+			APIIPBurst:     100,
+			APIPerMinute:   120,
+			APIBurst:       20,
+		},
+		Mail: MailSettings{
+			Port: 25,
+			From: "bookings@localhost",
+		},
+		Database: DatabaseSettings{
+			Host:     "localhost",
+			Port:     5432,
+			Name:     "bookings",
+			User:     "orfium",
+			Password: "1234",
+		},
+	}
+}
+
+// Addr returns the address the server listens on
+func (s Settings) Addr() string {
+	return fmt.Sprintf(":%d", s.Port)
+}
+
+// Enabled reports whether the server is served over https
+func (t TLSSettings) Enabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
+}
+
+// DSN returns the connection string for the database
+func (d DatabaseSettings) DSN() string {
+	dsn := fmt.Sprintf("host=%s port=%d dbname=%s user=%s", dsnValue(d.Host), d.Port, dsnValue(d.Name), dsnValue(d.User))
+	if d.Password != "" {
+		dsn = fmt.Sprintf("%s password=%s", dsn, dsnValue(d.Password))
+	}
+	if d.SSLMode != "" {
+		dsn = fmt.Sprintf("%s sslmode=%s", dsn, dsnValue(d.SSLMode))
+	}
+	return dsn
+}
+
+// dsnValue quotes a connection string value the way libpq expects, when it is empty or contains
+// spaces, quotes or backslashes
+func dsnValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, " \t\n\r\f\v'\\") {
+		return v
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+// LoadSettings builds the settings from, in increasing order of precedence, the defaults,
+// an optional YAML config file, BOOKINGS_* environment variables and command-line flags
+func LoadSettings(args []string, getenv func(string) string) (Settings, error) {
+	s := DefaultSettings()
+
+	fs := flag.NewFlagSet("bookings", flag.ContinueOnError)
+	configFile := fs.String("config", getenv("BOOKINGS_CONFIG"), "path to a YAML config file")
+	port := fs.Int("port", s.Port, "port to listen on")
+	inProduction := fs.Bool("production", s.InProduction, "run in production mode")
+	useCache := fs.Bool("cache", s.UseCache, "use the template cache")
+	dbQueryTimeout := fs.Duration("db-query-timeout", s.DBQueryTimeout, "time a single database query is allowed to run")
+	drainTimeout := fs.Duration("drain-timeout", s.DrainTimeout, "time in-flight requests get to complete on shutdown")
+	cancelDeadline := fs.Duration("cancel-deadline", s.CancelDeadline, "time before the arrival date until which guests can cancel their reservation")
+	tracingExporter := fs.String("tracing", s.Tracing, "where to export traces (stdout, otlp), disabled when empty")
+	tlsCert := fs.String("tls-cert", s.TLS.CertFile, "path to the tls certificate to serve https with")
+	tlsKey := fs.String("tls-key", s.TLS.KeyFile, "path to the tls private key to serve https with")
+	httpsRedirect := fs.Bool("https-redirect", s.HTTPSRedirect, "redirect http requests to https in production mode")
+	trustedProxyHeader := fs.String("trusted-proxy-header", s.TrustedProxyHeader, "header set by the proxy terminating tls to the request scheme, such as X-Forwarded-Proto")
+	trustedIPHeader := fs.String("trusted-ip-header", s.TrustedIPHeader, "header set by the proxy to the client ip, such as X-Forwarded-For")
+	ipPerMinute := fs.Int("rate-limit-ip", s.RateLimit.IPPerMinute, "availability searches and bookings allowed per client ip a minute, 0 to disable")
+	ipBurst := fs.Int("rate-limit-ip-burst", s.RateLimit.IPBurst, "burst of availability searches and bookings allowed per client ip")
+	apiIPPerMinute := fs.Int("rate-limit-api-ip", s.RateLimit.APIIPPerMinute, "api requests allowed per client ip a minute, before the api token is checked, 0 to disable")
+	apiIPBurst := fs.Int("rate-limit-api-ip-burst", s.RateLimit.APIIPBurst, "burst of api requests allowed per client ip")
+	apiPerMinute := fs.Int("rate-limit-api", s.RateLimit.APIPerMinute, "api requests allowed per api token a minute, 0 to disable")
+	apiBurst := fs.Int("rate-limit-api-burst", s.RateLimit.APIBurst, "burst of api requests allowed per api token")
+	smtpHost := fs.String("smtp-host", s.Mail.Host, "SMTP server the emails are sent through, emails are only logged when empty")
+	smtpPort := fs.Int("smtp-port", s.Mail.Port, "SMTP server port")
+	smtpUser := fs.String("smtp-user", s.Mail.Username, "SMTP user, no authentication when empty")
+	smtpPassword := fs.String("smtp-password", s.Mail.Password, "SMTP password")
+	mailFrom := fs.String("mail-from", s.Mail.From, "address the emails are sent from")
+	mailOwner := fs.String("mail-owner", s.Mail.Owner, "address the new reservations are notified to, no notification when empty")
+	dbHost := fs.String("db-host", s.Database.Host, "database host")
+	dbPort := fs.Int("db-port", s.Database.Port, "database port")
+	dbName := fs.String("db-name", s.Database.Name, "database name")
+	dbUser := fs.String("db-user", s.Database.User, "database user")
+	dbPassword := fs.String("db-password", s.Database.Password, "database password")
+	dbSSLMode := fs.String("db-sslmode", s.Database.SSLMode, "database ssl mode (disable, prefer, require, verify-full)")
+
+	if err := fs.Parse(args); err != nil {
+		return s, err
+	}
+
+	if *configFile != "" {
+		if err := s.readFile(*configFile); err != nil {
+			return s, err
+		}
+	}
+
+	if err := s.readEnv(getenv); err != nil {
+		return s, err
+	}
+
+	// only the flags given explicitly override the file and the environment
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			s.Port = *port
+		case "production":
+			s.InProduction = *inProduction
+		case "cache":
+			s.UseCache = *useCache
+		case "db-query-timeout":
+			s.DBQueryTimeout = *dbQueryTimeout
+		case "drain-timeout":
+			s.DrainTimeout = *drainTimeout
+		case "cancel-deadline":
+			s.CancelDeadline = *cancelDeadline
+		case "tracing":
+			s.Tracing = *tracingExporter
+		case "tls-cert":
+			s.TLS.CertFile = *tlsCert
+		case "tls-key":
+			s.TLS.KeyFile = *tlsKey
+		case "https-redirect":
+			s.HTTPSRedirect = *httpsRedirect
+		case "trusted-proxy-header":
+			s.TrustedProxyHeader = *trustedProxyHeader
+		case "trusted-ip-header":
+			s.TrustedIPHeader = *trustedIPHeader
+		case "rate-limit-ip":
+			s.RateLimit.IPPerMinute = *ipPerMinute
+		case "rate-limit-ip-burst":
+			s.RateLimit.IPBurst = *ipBurst
+		case "rate-limit-api-ip":
+			s.RateLimit.APIIPPerMinute = *apiIPPerMinute
+		case "rate-limit-api-ip-burst":
+			s.RateLimit.APIIPBurst = *apiIPBurst
+		case "rate-limit-api":
+			s.RateLimit.APIPerMinute = *apiPerMinute
+		case "rate-limit-api-burst":
+			s.RateLimit.APIBurst = *apiBurst
+		case "smtp-host":
+			s.Mail.Host = *smtpHost
+		case "smtp-port":
+			s.Mail.Port = *smtpPort
+		case "smtp-user":
+			s.Mail.Username = *smtpUser
+		case "smtp-password":
+			s.Mail.Password = *smtpPassword
+		case "mail-from":
+			s.Mail.From = *mailFrom
+		case "mail-owner":
+			s.Mail.Owner = *mailOwner
+		case "db-host":
+			s.Database.Host = *dbHost
+		case "db-port":
+			s.Database.Port = *dbPort
+		case "db-name":
+			s.Database.Name = *dbName
+		case "db-user":
+			s.Database.User = *dbUser
+		case "db-password":
+			s.Database.Password = *dbPassword
+		case "db-sslmode":
+			s.Database.SSLMode = *dbSSLMode
+		}
+	})
+
+	return s, s.Validate()
+}
+
+// readFile overrides the settings with the ones found in a YAML file
+func (s *Settings) readFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("cannot open config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(s); err != nil {
+		return fmt.Errorf("cannot parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// readEnv overrides the settings with the BOOKINGS_* environment variables that are set
+func (s *Settings) readEnv(getenv func(string) string) error {
+	var err error
+	str := func(name string, dst *string) {
+		if v := getenv(name); v != "" {
+			*dst = v
+		}
+	}
+	num := func(name string, dst *int) {
+		if v := getenv(name); v != "" && err == nil {
+			if *dst, err = strconv.Atoi(v); err != nil {
+				err = fmt.Errorf("invalid value %q for %s: must be a number", v, name)
+			}
+		}
+	}
+	boolean := func(name string, dst *bool) {
+		if v := getenv(name); v != "" && err == nil {
+			if *dst, err = strconv.ParseBool(v); err != nil {
+				err = fmt.Errorf("invalid value %q for %s: must be true or false", v, name)
+			}
+		}
+	}
+	duration := func(name string, dst *time.Duration) {
+		if v := getenv(name); v != "" && err == nil {
+			if *dst, err = time.ParseDuration(v); err != nil {
+				err = fmt.Errorf("invalid value %q for %s: must be a duration such as 3s", v, name)
+			}
+		}
+	}
+
+	num("BOOKINGS_PORT", &s.Port)
+	boolean("BOOKINGS_IN_PRODUCTION", &s.InProduction)
+	boolean("BOOKINGS_USE_CACHE", &s.UseCache)
+	duration("BOOKINGS_DB_QUERY_TIMEOUT", &s.DBQueryTimeout)
+	duration("BOOKINGS_DRAIN_TIMEOUT", &s.DrainTimeout)
+	duration("BOOKINGS_CANCEL_DEADLINE", &s.CancelDeadline)
+	str("BOOKINGS_TRACING", &s.Tracing)
+	str("BOOKINGS_TLS_CERT", &s.TLS.CertFile)
+	str("BOOKINGS_TLS_KEY", &s.TLS.KeyFile)
+	boolean("BOOKINGS_HTTPS_REDIRECT", &s.HTTPSRedirect)
+	str("BOOKINGS_TRUSTED_PROXY_HEADER", &s.TrustedProxyHeader)
+	str("BOOKINGS_TRUSTED_IP_HEADER", &s.TrustedIPHeader)
+	num("BOOKINGS_RATE_LIMIT_IP", &s.RateLimit.IPPerMinute)
+	num("BOOKINGS_RATE_LIMIT_IP_BURST", &s.RateLimit.IPBurst)
+	num("BOOKINGS_RATE_LIMIT_API_IP", &s.RateLimit.APIIPPerMinute)
+	num("BOOKINGS_RATE_LIMIT_API_IP_BURST", &s.RateLimit.APIIPBurst)
+	num("BOOKINGS_RATE_LIMIT_API", &s.RateLimit.APIPerMinute)
+	num("BOOKINGS_RATE_LIMIT_API_BURST", &s.RateLimit.APIBurst)
+	str("BOOKINGS_SMTP_HOST", &s.Mail.Host)
+	num("BOOKINGS_SMTP_PORT", &s.Mail.Port)
+	str("BOOKINGS_SMTP_USER", &s.Mail.Username)
+	str("BOOKINGS_SMTP_PASSWORD", &s.Mail.Password)
+	str("BOOKINGS_MAIL_FROM", &s.Mail.From)
+	str("BOOKINGS_MAIL_OWNER", &s.Mail.Owner)
+	str("BOOKINGS_DB_HOST", &s.Database.Host)
+	num("BOOKINGS_DB_PORT", &s.Database.Port)
+	str("BOOKINGS_DB_NAME", &s.Database.Name)
+	str("BOOKINGS_DB_USER", &s.Database.User)
+	str("BOOKINGS_DB_PASSWORD", &s.Database.Password)
+	str("BOOKINGS_DB_SSLMODE", &s.Database.SSLMode)
+
+	return err
+}
+
+// Validate returns an error listing every invalid setting
+func (s Settings) Validate() error {
+	var problems []string
+
+	if s.Port < 1 || s.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("port %d is out of range", s.Port))
+	}
+	if s.DBQueryTimeout <= 0 {
+		problems = append(problems, "db query timeout must be positive")
+	}
+	if s.DrainTimeout < 0 {
+		problems = append(problems, "drain timeout cannot be negative")
+	}
+	if s.CancelDeadline < 0 {
+		problems = append(problems, "cancel deadline cannot be negative")
+	}
+	switch s.Tracing {
+	case tracing.ExporterNone, tracing.ExporterStdout, tracing.ExporterOTLP:
+	default:
+		problems = append(problems, fmt.Sprintf("tracing exporter %q must be stdout or otlp", s.Tracing))
+	}
+	if (s.TLS.CertFile == "") != (s.TLS.KeyFile == "") {
+		problems = append(problems, "tls needs both a certificate and a key")
+	}
+	if s.HTTPSRedirect && !s.InProduction {
+		problems = append(problems, "https redirect is only available in production mode")
+	}
+	if s.HTTPSRedirect && !s.TLS.Enabled() && s.TrustedProxyHeader == "" {
+		// without either, every request looks like plain http and would be redirected forever
+		problems = append(problems, "https redirect needs tls or a trusted proxy header")
+	}
+	rl := s.RateLimit
+	if rl.IPPerMinute < 0 || rl.APIIPPerMinute < 0 || rl.APIPerMinute < 0 {
+		problems = append(problems, "rate limits cannot be negative")
+	}
+	if (rl.IPPerMinute > 0 && rl.IPBurst < 1) || (rl.APIIPPerMinute > 0 && rl.APIIPBurst < 1) ||
+		(rl.APIPerMinute > 0 && rl.APIBurst < 1) {
+		problems = append(problems, "rate limit bursts must be at least 1")
+	}
+	if s.Mail.Host != "" && (s.Mail.Port < 1 || s.Mail.Port > 65535) {
+		problems = append(problems, fmt.Sprintf("smtp port %d is out of range", s.Mail.Port))
+	}
+	if s.Mail.From == "" {
+		problems = append(problems, "mail from address is required")
+	}
+	if s.Database.Host == "" {
+		problems = append(problems, "database host is required")
+	}
+	if s.Database.Port < 1 || s.Database.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("database port %d is out of range", s.Database.Port))
+	}
+	if s.Database.Name == "" {
+		problems = append(problems, "database name is required")
+	}
+	if s.Database.User == "" {
+		problems = append(problems, "database user is required")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDefaultSettings(t *testing.T) {
+	s := DefaultSettings()
+
+	if err := s.Validate(); err != nil {
+		t.Errorf("default settings are invalid: %s", err)
+	}
+	if s.Addr() != ":8889" {
+		t.Errorf("expected address :8889, got %s", s.Addr())
+	}
+}
+
+func TestDatabaseSettings_DSN(t *testing.T) {
+	d := DatabaseSettings{
+		Host: "db",
+		Port: 5433,
+		Name: "bookings",
+		User: "app",
+	}
+	if d.DSN() != "host=db port=5433 dbname=bookings user=app" {
+		t.Errorf("unexpected dsn without password: %s", d.DSN())
+	}
+
+	d.Password = "secret"
+	d.SSLMode = "require"
+	if d.DSN() != "host=db port=5433 dbname=bookings user=app password=secret sslmode=require" {
+		t.Errorf("unexpected dsn with password: %s", d.DSN())
+	}
+
+	// values with spaces, quotes or backslashes are quoted and escaped
+	d.Password = `p@ss w'rd\`
+	d.User = ""
+	if d.DSN() != `host=db port=5433 dbname=bookings user='' password='p@ss w\'rd\\' sslmode=require` {
+		t.Errorf("unexpected dsn with special characters: %s", d.DSN())
+	}
+}
+
+func TestLoadSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	content := `
+port: 9000
+in_production: true
+db_query_timeout: 5s
+tracing: otlp
+https_redirect: true
+trusted_proxy_header: X-Forwarded-Proto
+trusted_ip_header: X-Forwarded-For
+rate_limit:
+  ip_per_minute: 10
+database:
+  host: file-host
+  name: file-db
+`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"BOOKINGS_CONFIG":  path,
+		"BOOKINGS_DB_HOST": "env-host",
+		"BOOKINGS_DB_USER": "env-user",
+	}
+	getenv := func(k string) string { return env[k] }
+
+	s, err := LoadSettings([]string{"-db-user", "flag-user"}, getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Port != 9000 {
+		t.Errorf("expected port from file 9000, got %d", s.Port)
+	}
+	if !s.InProduction {
+		t.Error("expected production mode from file")
+	}
+	if s.DBQueryTimeout != 5*time.Second {
+		t.Errorf("expected query timeout from file 5s, got %s", s.DBQueryTimeout)
+	}
+	if s.Tracing != "otlp" {
+		t.Errorf("expected tracing exporter from file otlp, got %s", s.Tracing)
+	}
+	if !s.HTTPSRedirect || s.TrustedProxyHeader != "X-Forwarded-Proto" {
+		t.Errorf("expected https redirect behind X-Forwarded-Proto from file, got %t and %q", s.HTTPSRedirect, s.TrustedProxyHeader)
+	}
+	if s.TrustedIPHeader != "X-Forwarded-For" {
+		t.Errorf("expected trusted ip header from file X-Forwarded-For, got %q", s.TrustedIPHeader)
+	}
+	if s.RateLimit.IPPerMinute != 10 || s.RateLimit.IPBurst != 10 {
+		t.Errorf("expected ip rate limit from file and default burst, got %d and %d", s.RateLimit.IPPerMinute, s.RateLimit.IPBurst)
+	}
+	if s.Database.Name != "file-db" {
+		t.Errorf("expected database name from file, got %s", s.Database.Name)
+	}
+	if s.Database.Host != "env-host" {
+		t.Errorf("expected database host from environment, got %s", s.Database.Host)
+	}
+	if s.Database.User != "flag-user" {
+		t.Errorf("expected database user from flag, got %s", s.Database.User)
+	}
+	if s.Database.Port != 5432 {
+		t.Errorf("expected default database port 5432, got %d", s.Database.Port)
+	}
+}
+
+var invalidSettingsTests = []struct {
+	name string
+	args []string
+	env  map[string]string
+}{
+	{"unknown flag", []string{"-nope"}, nil},
+	{"port out of range", []string{"-port", "70000"}, nil},
+	{"empty database name", []string{"-db-name", ""}, nil},
+	{"invalid env number", nil, map[string]string{"BOOKINGS_PORT": "http"}},
+	{"invalid env bool", nil, map[string]string{"BOOKINGS_IN_PRODUCTION": "maybe"}},
+	{"invalid env duration", nil, map[string]string{"BOOKINGS_DB_QUERY_TIMEOUT": "3"}},
+	{"negative cancel deadline", []string{"-cancel-deadline", "-1h"}, nil},
+	{"unknown tracing exporter", []string{"-tracing", "jaeger"}, nil},
+	{"tls cert without key", []string{"-tls-cert", "cert.pem"}, nil},
+	{"https redirect in development", []string{"-https-redirect", "-trusted-proxy-header", "X-Forwarded-Proto"}, nil},
+	{"https redirect without tls or proxy", []string{"-production", "-https-redirect"}, nil},
+	{"smtp port out of range", []string{"-smtp-host", "localhost", "-smtp-port", "0"}, nil},
+	{"empty mail from address", []string{"-mail-from", ""}, nil},
+	{"negative rate limit", []string{"-rate-limit-ip", "-1"}, nil},
+	{"zero rate limit burst", nil, map[string]string{"BOOKINGS_RATE_LIMIT_API_BURST": "0"}},
+	{"negative api ip rate limit", []string{"-rate-limit-api-ip", "-1"}, nil},
+	{"zero api ip rate limit burst", nil, map[string]string{"BOOKINGS_RATE_LIMIT_API_IP_BURST": "0"}},
+	{"missing config file", nil, map[string]string{"BOOKINGS_CONFIG": "/does/not/exist.yml"}},
+}
+
+func TestLoadSettings_Invalid(t *testing.T) {
+	for _, e := range invalidSettingsTests {
+		getenv := func(k string) string { return e.env[k] }
+		_, err := LoadSettings(e.args, getenv)
+		if err == nil {
+			t.Errorf("%s: expected an error but got none", e.name)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/tomdim/bookings/internal/forms"
+	"github.com/tomdim/bookings/internal/helpers"
+	"github.com/tomdim/bookings/internal/metrics"
+	"github.com/tomdim/bookings/internal/models"
+	"github.com/tomdim/bookings/internal/reference"
+	"github.com/tomdim/bookings/internal/repository"
+	"github.com/tomdim/bookings/internal/tracing"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// apiDateLayout is the layout of the dates sent to and returned by the api
+const apiDateLayout = "2006-01-02"
+
+// maxAPIBodyBytes is the largest request body the api reads
+const maxAPIBodyBytes = 1 << 20
+
+// apiEnvelope wraps every api response, holding either the data or the error
+type apiEnvelope struct {
+	Data  interface{} `json:"data,omitempty"`
+	Error *apiError   `json:"error,omitempty"`
+}
+
+// apiError describes why an api request failed. Fields holds the validation errors by field.
+type apiError struct {
+	Status  int                 `json:"status"`
+	Message string              `json:"message"`
+	Fields  map[string][]string `json:"fields,omitempty"`
+}
+
+type apiRoom struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type apiAvailability struct {
+	StartDate string    `json:"start_date"`
+	EndDate   string    `json:"end_date"`
+	Rooms     []apiRoom `json:"rooms"`
+}
+
+type apiReservationRequest struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+	Phone     string `json:"phone"`
+	RoomID    int    `json:"room_id"`
+	StartDate string `json:"start_date"`
+	EndDate   string `json:"end_date"`
+}
+
+type apiReservation struct {
+	ID        int     `json:"id"`
+	Reference string  `json:"reference"`
+	FirstName string  `json:"first_name"`
+	LastName  string  `json:"last_name"`
+	Email     string  `json:"email"`
+	Phone     string  `json:"phone"`
+	Room      apiRoom `json:"room"`
+	StartDate string  `json:"start_date"`
+	EndDate   string  `json:"end_date"`
+	Cancelled bool    `json:"cancelled"`
+}
+
+// APIRooms lists the rooms
+func (m *Repository) APIRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		m.apiServerError(w, r, err)
+		return
+	}
+
+	writeAPI(w, http.StatusOK, newAPIRooms(rooms))
+}
+
+// APIRoom returns a room by id
+func (m *Repository) APIRoom(w http.ResponseWriter, r *http.Request) {
+	roomID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || roomID < 1 {
+		writeAPIError(w, http.StatusBadRequest, "Invalid room id", nil)
+		return
+	}
+
+	room, err := m.DB.GetRoomByID(r.Context(), roomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeAPIError(w, http.StatusNotFound, "Room not found", nil)
+		return
+	}
+	if err != nil {
+		m.apiServerError(w, r, err)
+		return
+	}
+
+	writeAPI(w, http.StatusOK, apiRoom{ID: room.ID, Name: room.RoomName})
+}
+
+// APIAvailability lists the rooms available between the start and end dates, optionally
+// only checking the room given by room_id
+func (m *Repository) APIAvailability(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	form := forms.New(q)
+	startDate, endDate := parseAPIStay(form, "start", "end")
+	if q.Get("room_id") != "" {
+		if id, err := strconv.Atoi(q.Get("room_id")); err != nil || id < 1 {
+			form.Errors.Add("room_id", "Invalid room id.")
+		}
+	}
+	if !form.Valid() {
+		writeAPIError(w, http.StatusBadRequest, "Invalid availability search", form.Errors)
+		return
+	}
+
+	metrics.AvailabilitySearches.WithLabelValues("api").Inc()
+	trace.SpanFromContext(r.Context()).SetAttributes(tracing.Dates(startDate, endDate)...)
+
+	resp := apiAvailability{
+		StartDate: startDate.Format(apiDateLayout),
+		EndDate:   endDate.Format(apiDateLayout),
+		Rooms:     []apiRoom{},
+	}
+
+	if q.Get("room_id") == "" {
+		rooms, err := m.DB.SearchAvailabilityForAllRooms(r.Context(), startDate, endDate)
+		if err != nil {
+			m.apiServerError(w, r, err)
+			return
+		}
+		resp.Rooms = newAPIRooms(rooms)
+		writeAPI(w, http.StatusOK, resp)
+		return
+	}
+
+	roomID, _ := strconv.Atoi(q.Get("room_id"))
+	room, err := m.DB.GetRoomByID(r.Context(), roomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeAPIError(w, http.StatusNotFound, "Room not found", nil)
+		return
+	}
+	if err != nil {
+		m.apiServerError(w, r, err)
+		return
+	}
+
+	available, err := m.DB.SearchAvailabilityByDatesByRoomID(r.Context(), startDate, endDate, roomID)
+	if err != nil {
+		m.apiServerError(w, r, err)
+		return
+	}
+	if available {
+		resp.Rooms = append(resp.Rooms, apiRoom{ID: roomID, Name: room.RoomName})
+	}
+
+	writeAPI(w, http.StatusOK, resp)
+}
+
+// APIPostReservation books a room for a guest
+func (m *Repository) APIPostReservation(w http.ResponseWriter, r *http.Request) {
+	var req apiReservationRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBodyBytes))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&req)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %s", err), nil)
+		return
+	}
+
+	// the reservation is validated with the same rules as the reservation form
+	form := forms.New(url.Values{
+		"first_name": {req.FirstName},
+		"last_name":  {req.LastName},
+		"email":      {req.Email},
+		"phone":      {req.Phone},
+		"start_date": {req.StartDate},
+		"end_date":   {req.EndDate},
+	})
+	form.Required("first_name", "last_name", "email", "phone")
+	form.MinLength("first_name", 3)
+	form.IsEmail("email")
+	startDate, endDate := parseAPIStay(form, "start_date", "end_date")
+	if req.RoomID < 1 {
+		form.Errors.Add("room_id", "Invalid room id.")
+	}
+	if !form.Valid() {
+		writeAPIError(w, http.StatusUnprocessableEntity, "Invalid reservation", form.Errors)
+		return
+	}
+
+	room, err := m.DB.GetRoomByID(r.Context(), req.RoomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		form.Errors.Add("room_id", "Room does not exist.")
+		writeAPIError(w, http.StatusUnprocessableEntity, "Invalid reservation", form.Errors)
+		return
+	}
+	if err != nil {
+		m.apiServerError(w, r, err)
+		return
+	}
+
+	token, _ := helpers.APIToken(r)
+	reservation := models.Reservation{
+		FirstName:  req.FirstName,
+		LastName:   req.LastName,
+		Email:      req.Email,
+		Phone:      req.Phone,
+		StartDate:  startDate,
+		EndDate:    endDate,
+		RoomID:     req.RoomID,
+		Room:       room,
+		APITokenID: token.ID,
+	}
+	trace.SpanFromContext(r.Context()).SetAttributes(
+		tracing.Stay(reservation.RoomID, reservation.StartDate, reservation.EndDate)...)
+
+	newReservationID, reference, err := m.DB.CreateBookingTx(r.Context(), reservation)
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		writeAPIError(w, http.StatusConflict, "The room is not available for those dates", nil)
+		return
+	}
+	if err != nil {
+		m.apiServerError(w, r, err)
+		return
+	}
+	reservation.ID = newReservationID
+	reservation.Reference = reference
+	metrics.ReservationsCreated.Inc()
+	trace.SpanFromContext(r.Context()).SetAttributes(tracing.ReservationID.Int(newReservationID))
+
+	w.Header().Set("Location", "/api/v1/reservations/"+reference)
+	writeAPI(w, http.StatusCreated, newAPIReservation(reservation))
+}
+
+// APIReservation returns a reservation by its reference, as long as it was made with the calling token
+func (m *Repository) APIReservation(w http.ResponseWriter, r *http.Request) {
+	res, err := m.DB.GetReservationByReference(r.Context(), reference.Normalize(chi.URLParam(r, "ref")))
+	// reservations made on the website or with another token are not found, rather than
+	// forbidden, so that partners can't tell which references exist
+	if token, _ := helpers.APIToken(r); err == nil && (res.APITokenID == 0 || res.APITokenID != token.ID) {
+		err = sql.ErrNoRows
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		writeAPIError(w, http.StatusNotFound, "Reservation not found", nil)
+		return
+	}
+	if err != nil {
+		m.apiServerError(w, r, err)
+		return
+	}
+
+	writeAPI(w, http.StatusOK, newAPIReservation(res))
+}
+
+// APIAuthenticate returns the api token sent in the Authorization header as a bearer token.
+// When the token is missing or unknown it writes the error response and returns false.
+func (m *Repository) APIAuthenticate(w http.ResponseWriter, r *http.Request) (models.APIToken, bool) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+		writeAPIError(w, http.StatusUnauthorized, "Missing bearer token", nil)
+		return models.APIToken{}, false
+	}
+
+	t, err := m.DB.GetAPITokenByHash(r.Context(), helpers.HashAPIToken(strings.TrimSpace(token)))
+	if errors.Is(err, sql.ErrNoRows) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+		writeAPIError(w, http.StatusUnauthorized, "Invalid bearer token", nil)
+		return t, false
+	}
+	if err != nil {
+		m.apiServerError(w, r, err)
+		return t, false
+	}
+
+	trace.SpanFromContext(r.Context()).SetAttributes(tracing.APITokenID.Int(t.ID))
+	return t, true
+}
+
+// APIForbidden is the api response for tokens missing the scope a route requires
+func (m *Repository) APIForbidden(w http.ResponseWriter, r *http.Request, scope string) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="api", error="insufficient_scope", scope="%s"`, scope))
+	writeAPIError(w, http.StatusForbidden, fmt.Sprintf("The token is missing the %s scope", scope), nil)
+}
+
+// APITooManyRequests is the api response for tokens over their rate limit
+func (m *Repository) APITooManyRequests(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusTooManyRequests, "Too many requests, try again later", nil)
+}
+
+// APINotFound is the api response for unknown urls
+func (m *Repository) APINotFound(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusNotFound, "Not found", nil)
+}
+
+// APIMethodNotAllowed is the api response for known urls requested with an unsupported method
+func (m *Repository) APIMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed", nil)
+}
+
+// parseAPIStay parses the required start and end date fields of a form, adding an error to the
+// form for each date that is missing or invalid, or when the stay does not end after it starts
+func parseAPIStay(form *forms.Form, startField, endField string) (time.Time, time.Time) {
+	startDate, startErr := time.Parse(apiDateLayout, form.Get(startField))
+	if startErr != nil {
+		form.Errors.Add(startField, "Must be a date formatted as YYYY-MM-DD.")
+	}
+	endDate, endErr := time.Parse(apiDateLayout, form.Get(endField))
+	if endErr != nil {
+		form.Errors.Add(endField, "Must be a date formatted as YYYY-MM-DD.")
+	}
+	if startErr == nil && endErr == nil && !endDate.After(startDate) {
+		form.Errors.Add(endField, "Must be after the start date.")
+	}
+	return startDate, endDate
+}
+
+func newAPIRooms(rooms []models.Room) []apiRoom {
+	out := make([]apiRoom, 0, len(rooms))
+	for _, rm := range rooms {
+		out = append(out, apiRoom{ID: rm.ID, Name: rm.RoomName})
+	}
+	return out
+}
+
+func newAPIReservation(res models.Reservation) apiReservation {
+	return apiReservation{
+		ID:        res.ID,
+		Reference: res.Reference,
+		FirstName: res.FirstName,
+		LastName:  res.LastName,
+		Email:     res.Email,
+		Phone:     res.Phone,
+		Room:      apiRoom{ID: res.RoomID, Name: res.Room.RoomName},
+		StartDate: res.StartDate.Format(apiDateLayout),
+		EndDate:   res.EndDate.Format(apiDateLayout),
+		Cancelled: res.Cancelled == 1,
+	}
+}
+
+// apiServerError logs err and sends a 500 response that does not leak it
+func (m *Repository) apiServerError(w http.ResponseWriter, r *http.Request, err error) {
+	m.App.Logger.ErrorContext(r.Context(), "api request failed", "error", err)
+	writeAPIError(w, http.StatusInternalServerError, "Internal server error", nil)
+}
+
+// writeAPI writes data in the api envelope
+func writeAPI(w http.ResponseWriter, status int, data interface{}) {
+	writeAPIEnvelope(w, status, apiEnvelope{Data: data})
+}
+
+// writeAPIError writes an error in the api envelope
+func writeAPIError(w http.ResponseWriter, status int, message string, fields map[string][]string) {
+	writeAPIEnvelope(w, status, apiEnvelope{Error: &apiError{
+		Status:  status,
+		Message: message,
+		Fields:  fields,
+	}})
+}
+
+func writeAPIEnvelope(w http.ResponseWriter, status int, env apiEnvelope) {
+	out, _ := json.Marshal(env)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(out)
+}
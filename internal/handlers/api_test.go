@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/tomdim/bookings/internal/helpers"
+	"github.com/tomdim/bookings/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// apiTestResponse decodes the api envelope, keeping the data raw
+type apiTestResponse struct {
+	Data  json.RawMessage `json:"data"`
+	Error *apiError       `json:"error"`
+}
+
+var apiAvailabilityTests = []struct {
+	name               string
+	query              string
+	expectedStatusCode int
+	expectedRooms      int
+	expectedFields     []string
+}{
+	{"rooms available", "start=2050-01-01&end=2050-01-02", http.StatusOK, 1, nil},
+	{"no rooms available", "start=2050-02-01&end=2050-02-02", http.StatusOK, 0, nil},
+	{"room available", "start=2050-01-01&end=2050-01-02&room_id=2", http.StatusOK, 1, nil},
+	{"room not available", "start=2050-01-01&end=2050-01-02&room_id=1", http.StatusOK, 0, nil},
+	{"room does not exist", "start=2050-01-01&end=2050-01-02&room_id=99", http.StatusNotFound, 0, nil},
+	{"invalid dates", "start=tomorrow&end=2050-01-02&room_id=x", http.StatusBadRequest, 0, []string{"start", "room_id"}},
+	{"end before start", "start=2050-01-02&end=2050-01-01", http.StatusBadRequest, 0, []string{"end"}},
+	{"database error", "start=2000-01-01&end=2000-01-02", http.StatusInternalServerError, 0, nil},
+}
+
+func TestRepository_APIAvailability(t *testing.T) {
+	for _, e := range apiAvailabilityTests {
+		req, _ := http.NewRequest("GET", "/api/v1/availability?"+e.query, nil)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(Repo.APIAvailability).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: returned wrong response code: got %d, wanted %d", e.name, rr.Code, e.expectedStatusCode)
+		}
+
+		var resp apiTestResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: failed to parse json: %s", e.name, rr.Body.String())
+		}
+
+		if rr.Code != http.StatusOK {
+			if resp.Error == nil || resp.Error.Status != rr.Code {
+				t.Errorf("%s: expected an error envelope with status %d, got %s", e.name, rr.Code, rr.Body.String())
+				continue
+			}
+			for _, f := range e.expectedFields {
+				if _, ok := resp.Error.Fields[f]; !ok {
+					t.Errorf("%s: expected an error for field %s, got %v", e.name, f, resp.Error.Fields)
+				}
+			}
+			continue
+		}
+
+		var av apiAvailability
+		if err := json.Unmarshal(resp.Data, &av); err != nil {
+			t.Fatalf("%s: failed to parse data: %s", e.name, resp.Data)
+		}
+		if len(av.Rooms) != e.expectedRooms {
+			t.Errorf("%s: expected %d rooms, got %d", e.name, e.expectedRooms, len(av.Rooms))
+		}
+	}
+}
+
+var apiPostReservationTests = []struct {
+	name               string
+	body               string
+	expectedStatusCode int
+	expectedLocation   string
+}{
+	{
+		"valid reservation",
+		`{"first_name":"John","last_name":"Smith","email":"john@smith.com","phone":"123456789","room_id":1,"start_date":"2050-01-01","end_date":"2050-01-02"}`,
+		http.StatusCreated,
+		"/api/v1/reservations/BK-TEST-0001",
+	},
+	{
+		"invalid json",
+		`{"first_name":`,
+		http.StatusBadRequest,
+		"",
+	},
+	{
+		"unknown field",
+		`{"first_name":"John","nights":2}`,
+		http.StatusBadRequest,
+		"",
+	},
+	{
+		"invalid fields",
+		`{"first_name":"J","last_name":"Smith","email":"john","phone":"123456789","room_id":1,"start_date":"2050-01-02","end_date":"2050-01-01"}`,
+		http.StatusUnprocessableEntity,
+		"",
+	},
+	{
+		"room does not exist",
+		`{"first_name":"John","last_name":"Smith","email":"john@smith.com","phone":"123456789","room_id":99,"start_date":"2050-01-01","end_date":"2050-01-02"}`,
+		http.StatusUnprocessableEntity,
+		"",
+	},
+	{
+		"room just taken",
+		`{"first_name":"John","last_name":"Smith","email":"john@smith.com","phone":"123456789","room_id":4,"start_date":"2050-01-01","end_date":"2050-01-02"}`,
+		http.StatusConflict,
+		"",
+	},
+	{
+		"database error",
+		`{"first_name":"John","last_name":"Smith","email":"john@smith.com","phone":"123456789","room_id":2,"start_date":"2050-01-01","end_date":"2050-01-02"}`,
+		http.StatusInternalServerError,
+		"",
+	},
+}
+
+func TestRepository_APIPostReservation(t *testing.T) {
+	for _, e := range apiPostReservationTests {
+		req, _ := http.NewRequest("POST", "/api/v1/reservations", strings.NewReader(e.body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(Repo.APIPostReservation).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: returned wrong response code: got %d, wanted %d (%s)", e.name, rr.Code, e.expectedStatusCode, rr.Body.String())
+		}
+		if rr.Header().Get("Location") != e.expectedLocation {
+			t.Errorf("%s: expected location %q, got %q", e.name, e.expectedLocation, rr.Header().Get("Location"))
+		}
+		if rr.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s: expected json response, got %s", e.name, rr.Header().Get("Content-Type"))
+		}
+	}
+}
+
+var apiReservationTests = []struct {
+	name               string
+	ref                string
+	tokenID            int
+	expectedStatusCode int
+}{
+	{"made with the token", "BK-TEST-0001", 2, http.StatusOK},
+	{"made with another token", "BK-TEST-0001", 1, http.StatusNotFound},
+	{"made on the website", "BK-TEST-0002", 2, http.StatusNotFound},
+	{"not found", "BK-TEST-9999", 2, http.StatusNotFound},
+	{"database error", "BK-TEST-ERR1", 2, http.StatusInternalServerError},
+}
+
+func TestRepository_APIReservation(t *testing.T) {
+	for _, e := range apiReservationTests {
+		req, _ := http.NewRequest("GET", "/api/v1/reservations/"+e.ref, nil)
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("ref", e.ref)
+		ctx := context.WithValue(req.Context(), chi.RouteCtxKey, rctx)
+		req = req.WithContext(helpers.WithAPIToken(ctx, models.APIToken{ID: e.tokenID}))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(Repo.APIReservation).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: returned wrong response code: got %d, wanted %d", e.name, rr.Code, e.expectedStatusCode)
+		}
+	}
+}
+
+var apiAuthenticateTests = []struct {
+	name               string
+	authorization      string
+	expectedOK         bool
+	expectedStatusCode int
+	expectedTokenID    int
+}{
+	{"valid token", "Bearer bk_test_reservations", true, http.StatusOK, 2},
+	{"lowercase scheme", "bearer bk_test_availability", true, http.StatusOK, 1},
+	{"missing header", "", false, http.StatusUnauthorized, 0},
+	{"basic auth", "Basic dXNlcjpwYXNz", false, http.StatusUnauthorized, 0},
+	{"unknown token", "Bearer bk_revoked", false, http.StatusUnauthorized, 0},
+}
+
+func TestRepository_APIAuthenticate(t *testing.T) {
+	for _, e := range apiAuthenticateTests {
+		req, _ := http.NewRequest("GET", "/api/v1/rooms", nil)
+		if e.authorization != "" {
+			req.Header.Set("Authorization", e.authorization)
+		}
+		rr := httptest.NewRecorder()
+
+		token, ok := Repo.APIAuthenticate(rr, req)
+
+		if ok != e.expectedOK {
+			t.Errorf("%s: expected ok to be %t", e.name, e.expectedOK)
+		}
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: returned wrong response code: got %d, wanted %d", e.name, rr.Code, e.expectedStatusCode)
+		}
+		if token.ID != e.expectedTokenID {
+			t.Errorf("%s: expected token %d, got %d", e.name, e.expectedTokenID, token.ID)
+		}
+		if !ok && rr.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: expected a WWW-Authenticate challenge", e.name)
+		}
+	}
+}
@@ -1,18 +1,31 @@
 package handlers
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/tomdim/bookings/internal/config"
 	"github.com/tomdim/bookings/internal/driver"
 	"github.com/tomdim/bookings/internal/forms"
+	"github.com/tomdim/bookings/internal/helpers"
+	"github.com/tomdim/bookings/internal/metrics"
 	"github.com/tomdim/bookings/internal/models"
+	"github.com/tomdim/bookings/internal/pricing"
+	"github.com/tomdim/bookings/internal/reference"
 	"github.com/tomdim/bookings/internal/render"
 	"github.com/tomdim/bookings/internal/repository"
 	"github.com/tomdim/bookings/internal/repository/dbrepo"
+	"github.com/tomdim/bookings/internal/tracing"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Repo the repository used by the handlers
@@ -69,7 +82,7 @@ func (m *Repository) Reservation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	room, err := m.DB.GetRoomByID(reservation.RoomID)
+	room, err := m.DB.GetRoomByID(r.Context(), reservation.RoomID)
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "Can't find room")
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
@@ -77,6 +90,18 @@ func (m *Repository) Reservation(w http.ResponseWriter, r *http.Request) {
 	}
 
 	reservation.Room = room
+	quote, err := m.quote(r.Context(), reservation)
+	if errors.Is(err, pricing.ErrNoNights) {
+		m.App.Session.Put(r.Context(), "error", "Invalid dates")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Error connecting to database")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
 	m.App.Session.Put(r.Context(), "reservation", reservation)
 
 	sd := reservation.StartDate.Format("2006-01-02")
@@ -84,6 +109,7 @@ func (m *Repository) Reservation(w http.ResponseWriter, r *http.Request) {
 
 	data := make(map[string]interface{})
 	data["reservation"] = reservation
+	data["quote"] = quote
 
 	stringMap := make(map[string]string)
 	stringMap["start_date"] = sd
@@ -132,38 +158,96 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//var newReservationID int
-	newReservationID, err := m.DB.InsertReservation(reservation)
+	trace.SpanFromContext(r.Context()).SetAttributes(
+		tracing.Stay(reservation.RoomID, reservation.StartDate, reservation.EndDate)...)
+
+	// the reservation and the restriction blocking its room are inserted atomically
+	newReservationID, reference, err := m.DB.CreateBookingTx(r.Context(), reservation)
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		m.App.Session.Put(r.Context(), "error", "Sorry, this room was just taken for those dates. Please search again.")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
 	if err != nil {
+		m.App.Logger.ErrorContext(r.Context(), "cannot create booking", "error", err)
 		m.App.Session.Put(r.Context(), "error", "Can't insert reservation into database")
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 		return
 	}
 	reservation.ID = newReservationID
+	reservation.Reference = reference
+	metrics.ReservationsCreated.Inc()
+	trace.SpanFromContext(r.Context()).SetAttributes(tracing.ReservationID.Int(newReservationID))
 
-	roomRestriction := models.RoomRestriction{
-		StartDate:     reservation.StartDate,
-		EndDate:       reservation.EndDate,
-		RoomID:        reservation.RoomID,
-		ReservationID: reservation.ID,
-		RestrictionID: 1,
-	}
-	err = m.DB.InsertRoomRestriction(roomRestriction)
-	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "Can't insert room restriction into database")
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
-		return
-	}
+	m.sendReservationMails(r, reservation)
 
 	m.App.Session.Put(r.Context(), "reservation", reservation)
 	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
 }
 
+// sendReservationMails queues the confirmation to the guest and the notification to the owner of
+// a new reservation. The reservation is made whether or not they can be sent, so errors are only
+// logged.
+func (m *Repository) sendReservationMails(r *http.Request, reservation models.Reservation) {
+	td := &models.TemplateData{
+		Data: map[string]interface{}{"reservation": reservation},
+	}
+
+	mails := []struct {
+		to      string
+		subject string
+		tmpl    string
+	}{
+		{reservation.Email, "Reservation confirmation", "reservation-confirmation.mail.tmpl"},
+		{m.App.MailOwner, "New reservation", "reservation-notification.mail.tmpl"},
+	}
+	for _, mail := range mails {
+		if mail.to == "" {
+			continue
+		}
+		content, err := render.Mail(mail.tmpl, td)
+		if err != nil {
+			m.App.Logger.ErrorContext(r.Context(), "cannot render mail", "template", mail.tmpl, "error", err)
+			continue
+		}
+		m.queueMail(r, models.MailData{
+			To:      mail.to,
+			From:    m.App.MailFrom,
+			Subject: mail.subject,
+			Content: content,
+		})
+	}
+}
+
+// queueMail hands a mail over to the mailer, dropping it rather than holding up the request when
+// the mail queue is full
+func (m *Repository) queueMail(r *http.Request, mail models.MailData) {
+	select {
+	case m.App.MailChan <- mail:
+	default:
+		m.App.Logger.ErrorContext(r.Context(), "mail queue is full, dropping mail", "to", mail.To, "subject", mail.Subject)
+	}
+}
+
+// quote prices a reservation, evaluating the rate plans of its room night by night
+func (m *Repository) quote(ctx context.Context, res models.Reservation) (pricing.Quote, error) {
+	// the dates are checked first, so that a stay without nights does not hit the database
+	if pricing.Nights(res.StartDate, res.EndDate) < 1 {
+		return pricing.Quote{}, pricing.ErrNoNights
+	}
+
+	plans, err := m.DB.GetRatePlansByDates(ctx, res.StartDate, res.EndDate)
+	if err != nil {
+		return pricing.Quote{}, err
+	}
+	return pricing.ForReservation(res, plans)
+}
+
 // ReservationSummary renders a summary for a reservation made
 func (m *Repository) ReservationSummary(w http.ResponseWriter, r *http.Request) {
 	reservation, ok := m.App.Session.Get(r.Context(), "reservation").(models.Reservation)
 	if !ok {
-		m.App.ErrorLog.Println("Cannot get reservation from session")
+		m.App.Logger.ErrorContext(r.Context(), "cannot get reservation from session")
 		m.App.Session.Put(r.Context(), "error", "Can't get reservation from session. :(")
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 	}
@@ -171,6 +255,14 @@ func (m *Repository) ReservationSummary(w http.ResponseWriter, r *http.Request)
 	data := make(map[string]interface{})
 	data["reservation"] = reservation
 
+	// the reservation is made by now, so a stay that cannot be priced only leaves out the price
+	quote, err := m.quote(r.Context(), reservation)
+	if err != nil {
+		m.App.Logger.ErrorContext(r.Context(), "cannot price reservation", "error", err)
+	} else {
+		data["quote"] = quote
+	}
+
 	sd := reservation.StartDate.Format("2006-01-02")
 	ed := reservation.EndDate.Format("2006-01-02")
 	stringMap := make(map[string]string)
@@ -183,6 +275,126 @@ func (m *Repository) ReservationSummary(w http.ResponseWriter, r *http.Request)
 	})
 }
 
+// MyReservation renders the form guests look up their reservation with
+func (m *Repository) MyReservation(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "my-reservation.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostMyReservation shows a guest the reservation matching the reference and email they posted
+func (m *Repository) PostMyReservation(w http.ResponseWriter, r *http.Request) {
+	res, form, ok := m.lookupGuestReservation(w, r)
+	if !ok {
+		return
+	}
+
+	m.renderMyReservation(w, r, form, res)
+}
+
+// PostCancelMyReservation cancels the reservation matching the reference and email posted by a
+// guest, as long as its cancel deadline has not passed
+func (m *Repository) PostCancelMyReservation(w http.ResponseWriter, r *http.Request) {
+	res, form, ok := m.lookupGuestReservation(w, r)
+	if !ok {
+		return
+	}
+
+	if !res.CanCancel(time.Now(), m.App.CancelDeadline) {
+		m.App.Session.Put(r.Context(), "error", "This reservation can no longer be cancelled online")
+		m.renderMyReservation(w, r, form, res)
+		return
+	}
+
+	err := m.DB.CancelReservation(r.Context(), res.ID)
+	if err != nil {
+		m.App.Logger.ErrorContext(r.Context(), "cannot cancel reservation", "reservation_id", res.ID, "error", err)
+		m.App.Session.Put(r.Context(), "error", "Can't cancel reservation")
+		http.Redirect(w, r, "/my-reservation", http.StatusSeeOther)
+		return
+	}
+	res.Cancelled = 1
+	metrics.ReservationsCancelled.Inc()
+
+	if m.App.MailOwner != "" {
+		content, err := render.Mail("reservation-cancelled.mail.tmpl", &models.TemplateData{
+			Data: map[string]interface{}{"reservation": res},
+		})
+		if err != nil {
+			m.App.Logger.ErrorContext(r.Context(), "cannot render mail", "template", "reservation-cancelled.mail.tmpl", "error", err)
+		} else {
+			m.queueMail(r, models.MailData{
+				To:      m.App.MailOwner,
+				From:    m.App.MailFrom,
+				Subject: "Reservation cancelled",
+				Content: content,
+			})
+		}
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Your reservation was cancelled")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// lookupGuestReservation returns the reservation matching the reference and email posted by a
+// guest. A wrong email gets the same answer as an unknown reference, so that the form cannot be
+// used to find out which references exist.
+func (m *Repository) lookupGuestReservation(w http.ResponseWriter, r *http.Request) (models.Reservation, *forms.Form, bool) {
+	var res models.Reservation
+
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't parse form")
+		http.Redirect(w, r, "/my-reservation", http.StatusSeeOther)
+		return res, nil, false
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("reference", "email")
+	form.IsEmail("email")
+	if !form.Valid() {
+		render.Template(w, r, "my-reservation.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return res, nil, false
+	}
+
+	res, err = m.DB.GetReservationByReference(r.Context(), reference.Normalize(form.Get("reference")))
+	if err == nil && !strings.EqualFold(res.Email, strings.TrimSpace(form.Get("email"))) {
+		err = sql.ErrNoRows
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", "No reservation matches this reference and email")
+		http.Redirect(w, r, "/my-reservation", http.StatusSeeOther)
+		return res, nil, false
+	}
+	if err != nil {
+		m.App.Logger.ErrorContext(r.Context(), "cannot get reservation by reference", "error", err)
+		m.App.Session.Put(r.Context(), "error", "Can't get reservation from database")
+		http.Redirect(w, r, "/my-reservation", http.StatusSeeOther)
+		return res, nil, false
+	}
+
+	return res, form, true
+}
+
+// renderMyReservation renders the reservation of a guest, with the form to cancel it while it
+// can still be cancelled
+func (m *Repository) renderMyReservation(w http.ResponseWriter, r *http.Request, form *forms.Form, res models.Reservation) {
+	data := make(map[string]interface{})
+	data["reservation"] = res
+	data["can_cancel"] = res.CanCancel(time.Now(), m.App.CancelDeadline)
+
+	stringMap := make(map[string]string)
+	stringMap["cancel_deadline"] = fmt.Sprintf("%d hours", int(m.App.CancelDeadline.Hours()))
+
+	render.Template(w, r, "my-reservation.page.tmpl", &models.TemplateData{
+		Form:      form,
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
 // Generals renders the General's Quarters room page
 func (m *Repository) Generals(w http.ResponseWriter, r *http.Request) {
 	render.Template(w, r, "generals.page.tmpl", &models.TemplateData{})
@@ -199,11 +411,38 @@ func (m *Repository) Availability(w http.ResponseWriter, r *http.Request) {
 }
 
 type jsonResponse struct {
-	OK        bool   `json:"ok"`
-	Message   string `json:"message"`
-	RoomID    string `json:"room_id"`
-	StartDate string `json:"start_date"`
-	EndDate   string `json:"end_date"`
+	OK        bool       `json:"ok"`
+	Message   string     `json:"message"`
+	RoomID    string     `json:"room_id"`
+	StartDate string     `json:"start_date"`
+	EndDate   string     `json:"end_date"`
+	Quote     *jsonQuote `json:"quote,omitempty"`
+}
+
+// jsonQuote is the price of the stay searched for, in cents
+type jsonQuote struct {
+	Nights int             `json:"nights"`
+	Lines  []jsonQuoteLine `json:"lines"`
+	Total  int             `json:"total"`
+}
+
+type jsonQuoteLine struct {
+	Name     string `json:"name,omitempty"`
+	Nights   int    `json:"nights"`
+	Rate     int    `json:"rate"`
+	Subtotal int    `json:"subtotal"`
+}
+
+func newJSONQuote(q pricing.Quote) *jsonQuote {
+	out := &jsonQuote{
+		Nights: q.Nights,
+		Lines:  make([]jsonQuoteLine, 0, len(q.Lines)),
+		Total:  q.Total,
+	}
+	for _, l := range q.Lines {
+		out.Lines = append(out.Lines, jsonQuoteLine{Name: l.Name, Nights: l.Nights, Rate: l.Rate, Subtotal: l.Subtotal})
+	}
+	return out
 }
 
 // AvailabilityJSON handles request for availability and send json response
@@ -249,6 +488,16 @@ func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
 		w.Write(out)
 		return
 	}
+	if pricing.Nights(startDate, endDate) < 1 {
+		resp := jsonResponse{
+			OK:      false,
+			Message: "The departure date must be after the arrival date",
+		}
+		out, _ := json.MarshalIndent(resp, "", "    ")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+		return
+	}
 	roomID, err := strconv.Atoi(r.Form.Get("room_id"))
 	if err != nil {
 		// can't parse form, so return appropriate json
@@ -261,7 +510,8 @@ func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
 		w.Write(out)
 		return
 	}
-	available, err := m.DB.SearchAvailabilityByDatesByRoomID(startDate, endDate, roomID)
+	metrics.AvailabilitySearches.WithLabelValues("json").Inc()
+	available, err := m.DB.SearchAvailabilityByDatesByRoomID(r.Context(), startDate, endDate, roomID)
 	if err != nil {
 		// can't parse form, so return appropriate json
 		resp := jsonResponse{
@@ -274,12 +524,41 @@ func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var quote *jsonQuote
+	if available {
+		// the price is only quoted for a room that can be booked
+		room, err := m.DB.GetRoomByID(r.Context(), roomID)
+		if err != nil {
+			resp := jsonResponse{
+				OK:      false,
+				Message: "Error connecting to database",
+			}
+			out, _ := json.MarshalIndent(resp, "", "    ")
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(out)
+			return
+		}
+		q, err := m.quote(r.Context(), models.Reservation{StartDate: startDate, EndDate: endDate, RoomID: roomID, Room: room})
+		if err != nil {
+			resp := jsonResponse{
+				OK:      false,
+				Message: "Error connecting to database",
+			}
+			out, _ := json.MarshalIndent(resp, "", "    ")
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(out)
+			return
+		}
+		quote = newJSONQuote(q)
+	}
+
 	resp := jsonResponse{
 		OK:        available,
 		Message:   "",
 		StartDate: sd,
 		EndDate:   ed,
 		RoomID:    strconv.Itoa(roomID),
+		Quote:     quote,
 	}
 
 	// Removed error check, since we handle all aspects of json
@@ -313,7 +592,7 @@ func (m *Repository) BookRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	room, err := m.DB.GetRoomByID(roomID)
+	room, err := m.DB.GetRoomByID(r.Context(), roomID)
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "Error connecting to database")
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
@@ -357,8 +636,15 @@ func (m *Repository) PostAvailability(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/search-availability", http.StatusTemporaryRedirect)
 		return
 	}
+	if pricing.Nights(startDate, endDate) < 1 {
+		m.App.Session.Put(r.Context(), "error", "The departure date must be after the arrival date")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
 
-	rooms, err := m.DB.SearchAvailabilityForAllRooms(startDate, endDate)
+	metrics.AvailabilitySearches.WithLabelValues("form").Inc()
+	trace.SpanFromContext(r.Context()).SetAttributes(tracing.Dates(startDate, endDate)...)
+	rooms, err := m.DB.SearchAvailabilityForAllRooms(r.Context(), startDate, endDate)
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "Error connecting to database")
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
@@ -367,13 +653,33 @@ func (m *Repository) PostAvailability(w http.ResponseWriter, r *http.Request) {
 
 	if len(rooms) == 0 {
 		// no availability
+		metrics.NoAvailability.Inc()
 		m.App.Session.Put(r.Context(), "error", "No Availability")
 		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
 		return
 	}
 
+	plans, err := m.DB.GetRatePlansByDates(r.Context(), startDate, endDate)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Error connecting to database")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	quotes := make(map[int]pricing.Quote)
+	for _, room := range rooms {
+		quote, err := pricing.Calculate(room, plans, startDate, endDate)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "Invalid dates")
+			http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+			return
+		}
+		quotes[room.ID] = quote
+	}
+
 	data := make(map[string]interface{})
 	data["rooms"] = rooms
+	data["quotes"] = quotes
 
 	res := models.Reservation{
 		StartDate: startDate,
@@ -399,14 +705,16 @@ func (m *Repository) ChooseRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	trace.SpanFromContext(r.Context()).SetAttributes(tracing.RoomID.Int(roomID))
+
 	res, ok := m.App.Session.Get(r.Context(), "reservation").(models.Reservation)
 	if !ok {
-		m.App.ErrorLog.Println("Cannot get reservation from session")
+		m.App.Logger.ErrorContext(r.Context(), "cannot get reservation from session")
 		m.App.Session.Put(r.Context(), "error", "Can't get reservation from session. :(")
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 	}
 
-	room, err := m.DB.GetRoomByID(roomID)
+	room, err := m.DB.GetRoomByID(r.Context(), roomID)
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "Error connecting to database")
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
@@ -418,3 +726,765 @@ func (m *Repository) ChooseRoom(w http.ResponseWriter, r *http.Request) {
 
 	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
 }
+
+// ShowLogin renders the login page
+func (m *Repository) ShowLogin(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "login.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostShowLogin handles logging the user in
+func (m *Repository) PostShowLogin(w http.ResponseWriter, r *http.Request) {
+	// prevents session fixation attacks
+	_ = m.App.Session.RenewToken(r.Context())
+
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't parse form")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	email := r.Form.Get("email")
+	password := r.Form.Get("password")
+
+	form := forms.New(r.PostForm)
+	form.Required("email", "password")
+	form.IsEmail("email")
+	if !form.Valid() {
+		render.Template(w, r, "login.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	id, _, err := m.DB.Authenticate(r.Context(), email, password)
+	if err != nil {
+		m.App.Logger.InfoContext(r.Context(), "login failed", "email", email, "error", err)
+		m.App.Session.Put(r.Context(), "error", "Invalid login credentials")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(r.Context(), id)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't get user from database")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "user_id", id)
+	m.App.Session.Put(r.Context(), "access_level", user.AccessLevel)
+	m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// Logout logs a user out
+func (m *Repository) Logout(w http.ResponseWriter, r *http.Request) {
+	_ = m.App.Session.Destroy(r.Context())
+	_ = m.App.Session.RenewToken(r.Context())
+
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// AccessLevel returns the access level of the logged in user. It is read from the database rather
+// than the session, so that a demoted or deleted user loses access on their next request instead of
+// when their session expires.
+func (m *Repository) AccessLevel(r *http.Request) (int, error) {
+	user, err := m.DB.GetUserByID(r.Context(), m.App.Session.GetInt(r.Context(), "user_id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// keep the menus, which go by the session, in step
+	m.App.Session.Put(r.Context(), "access_level", user.AccessLevel)
+	return user.AccessLevel, nil
+}
+
+// Forbidden renders the page shown when a user lacks the access level for a page
+func (m *Repository) Forbidden(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusForbidden)
+	render.Template(w, r, "forbidden.page.tmpl", &models.TemplateData{})
+}
+
+// TooManyRequests renders the page shown when a client is over its rate limit
+func (m *Repository) TooManyRequests(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusTooManyRequests)
+	render.Template(w, r, "too-many-requests.page.tmpl", &models.TemplateData{})
+}
+
+// JSONTooManyRequests is the availability json response for clients over their rate limit
+func (m *Repository) JSONTooManyRequests(w http.ResponseWriter, r *http.Request) {
+	resp := jsonResponse{
+		OK:      false,
+		Message: "Too many requests, try again later",
+	}
+	out, _ := json.MarshalIndent(resp, "", "    ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write(out)
+}
+
+// AdminDashboard renders the admin dashboard
+func (m *Repository) AdminDashboard(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "admin-dashboard.page.tmpl", &models.TemplateData{})
+}
+
+// AdminNewReservations shows all new reservations in the admin tool
+func (m *Repository) AdminNewReservations(w http.ResponseWriter, r *http.Request) {
+	reservations, err := m.DB.NewReservations(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["reservations"] = reservations
+
+	render.Template(w, r, "admin-new-reservations.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminAllReservations shows all reservations in the admin tool
+func (m *Repository) AdminAllReservations(w http.ResponseWriter, r *http.Request) {
+	reservations, err := m.DB.AllReservations(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["reservations"] = reservations
+
+	render.Template(w, r, "admin-all-reservations.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminFindReservation opens the reservation with the reference given in the query string
+func (m *Repository) AdminFindReservation(w http.ResponseWriter, r *http.Request) {
+	ref := reference.Normalize(r.URL.Query().Get("reference"))
+	if ref == "" {
+		m.App.Session.Put(r.Context(), "error", "Enter a reservation reference")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	res, err := m.DB.GetReservationByReference(r.Context(), ref)
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("No reservation found with reference %s", ref))
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/admin/reservations/all/%d", res.ID), http.StatusSeeOther)
+}
+
+// adminReservationSources maps the admin pages a reservation can be opened from to their urls
+var adminReservationSources = map[string]string{
+	"new": "/admin/reservations-new",
+	"all": "/admin/reservations-all",
+	"cal": "/admin/reservations-calendar",
+}
+
+// adminReservationParams returns the id of the reservation in the url, along with the admin page it
+// was opened from. It writes a bad request and returns false when either is invalid.
+func adminReservationParams(w http.ResponseWriter, r *http.Request) (int, string, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	src := chi.URLParam(r, "src")
+	if _, known := adminReservationSources[src]; err != nil || !known {
+		helpers.ClientError(w, r, http.StatusBadRequest)
+		return 0, "", false
+	}
+	return id, src, true
+}
+
+// AdminShowReservation shows a single reservation in the admin tool
+func (m *Repository) AdminShowReservation(w http.ResponseWriter, r *http.Request) {
+	id, src, ok := adminReservationParams(w, r)
+	if !ok {
+		return
+	}
+
+	res, err := m.DB.GetReservationByID(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		helpers.ClientError(w, r, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["src"] = src
+
+	data := make(map[string]interface{})
+	data["reservation"] = res
+
+	render.Template(w, r, "admin-reservations-show.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+		Form:      forms.New(nil),
+	})
+}
+
+// AdminPostShowReservation updates the guest details of a reservation in the admin tool
+func (m *Repository) AdminPostShowReservation(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	id, src, ok := adminReservationParams(w, r)
+	if !ok {
+		return
+	}
+
+	res, err := m.DB.GetReservationByID(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		helpers.ClientError(w, r, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	res.FirstName = r.Form.Get("first_name")
+	res.LastName = r.Form.Get("last_name")
+	res.Email = r.Form.Get("email")
+	res.Phone = r.Form.Get("phone")
+
+	form := forms.New(r.PostForm)
+	form.Required("first_name", "last_name", "email", "phone")
+	form.MinLength("first_name", 3)
+	form.IsEmail("email")
+
+	if !form.Valid() {
+		stringMap := make(map[string]string)
+		stringMap["src"] = src
+
+		data := make(map[string]interface{})
+		data["reservation"] = res
+
+		render.Template(w, r, "admin-reservations-show.page.tmpl", &models.TemplateData{
+			StringMap: stringMap,
+			Data:      data,
+			Form:      form,
+		})
+		return
+	}
+
+	err = m.DB.UpdateReservation(r.Context(), res)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Changes saved")
+	http.Redirect(w, r, adminReservationSources[src], http.StatusSeeOther)
+}
+
+// AdminDeleteReservation deletes a reservation and its room restriction in the admin tool
+func (m *Repository) AdminDeleteReservation(w http.ResponseWriter, r *http.Request) {
+	id, src, ok := adminReservationParams(w, r)
+	if !ok {
+		return
+	}
+
+	err := m.DB.DeleteReservation(r.Context(), id)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Reservation deleted")
+	http.Redirect(w, r, adminReservationSources[src], http.StatusSeeOther)
+}
+
+// AdminProcessReservation marks a reservation as processed or unprocessed in the admin tool
+func (m *Repository) AdminProcessReservation(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	id, src, ok := adminReservationParams(w, r)
+	if !ok {
+		return
+	}
+
+	processed := 0
+	if r.Form.Get("processed") == "1" {
+		processed = 1
+	}
+
+	err = m.DB.UpdateProcessedForReservation(r.Context(), id, processed)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	if processed == 1 {
+		m.App.Session.Put(r.Context(), "flash", "Reservation marked as processed")
+	} else {
+		m.App.Session.Put(r.Context(), "flash", "Reservation marked as unprocessed")
+	}
+	http.Redirect(w, r, adminReservationSources[src], http.StatusSeeOther)
+}
+
+// AdminReservationsCalendar displays the reservations calendar of a month for all rooms
+func (m *Repository) AdminReservationsCalendar(w http.ResponseWriter, r *http.Request) {
+	// assume that there is no month/year specified
+	now := time.Now()
+
+	if r.URL.Query().Get("y") != "" {
+		year, _ := strconv.Atoi(r.URL.Query().Get("y"))
+		month, _ := strconv.Atoi(r.URL.Query().Get("m"))
+		now = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	data := make(map[string]interface{})
+	data["now"] = now
+
+	next := now.AddDate(0, 1, 0)
+	last := now.AddDate(0, -1, 0)
+
+	stringMap := make(map[string]string)
+	stringMap["next_month"] = next.Format("01")
+	stringMap["next_month_year"] = next.Format("2006")
+	stringMap["last_month"] = last.Format("01")
+	stringMap["last_month_year"] = last.Format("2006")
+	stringMap["this_month"] = now.Format("01")
+	stringMap["this_month_year"] = now.Format("2006")
+
+	// get the first and last days of the month
+	currentYear, currentMonth, _ := now.Date()
+	currentLocation := now.Location()
+	firstOfMonth := time.Date(currentYear, currentMonth, 1, 0, 0, 0, 0, currentLocation)
+	lastOfMonth := firstOfMonth.AddDate(0, 1, -1)
+
+	intMap := make(map[string]int)
+	intMap["days_in_month"] = lastOfMonth.Day()
+
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	data["rooms"] = rooms
+
+	for _, x := range rooms {
+		// create maps
+		reservationMap := make(map[string]int)
+		blockMap := make(map[string]int)
+
+		for d := firstOfMonth; !d.After(lastOfMonth); d = d.AddDate(0, 0, 1) {
+			reservationMap[d.Format("2006-01-2")] = 0
+			blockMap[d.Format("2006-01-2")] = 0
+		}
+
+		// get all the restrictions for the current room
+		restrictions, err := m.DB.GetRestrictionsForRoomByDate(r.Context(), x.ID, firstOfMonth, lastOfMonth)
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+
+		for _, y := range restrictions {
+			if y.ReservationID > 0 {
+				// it's a reservation, the departure day stays free
+				for d := y.StartDate; d.Before(y.EndDate); d = d.AddDate(0, 0, 1) {
+					reservationMap[d.Format("2006-01-2")] = y.ReservationID
+				}
+			} else {
+				// it's an owner block
+				blockMap[y.StartDate.Format("2006-01-2")] = y.ID
+			}
+		}
+		data[fmt.Sprintf("reservation_map_%d", x.ID)] = reservationMap
+		data[fmt.Sprintf("block_map_%d", x.ID)] = blockMap
+
+		m.App.Session.Put(r.Context(), fmt.Sprintf("block_map_%d", x.ID), blockMap)
+	}
+
+	render.Template(w, r, "admin-reservations-calendar.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+		IntMap:    intMap,
+	})
+}
+
+// AdminPostReservationsCalendar saves the owner blocks toggled on the reservations calendar
+func (m *Repository) AdminPostReservationsCalendar(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	year, _ := strconv.Atoi(r.Form.Get("y"))
+	month, _ := strconv.Atoi(r.Form.Get("m"))
+
+	// process blocks
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	roomNames := make(map[int]string)
+	for _, x := range rooms {
+		roomNames[x.ID] = x.RoomName
+	}
+
+	// read the new blocks first, so that a malformed form changes nothing
+	var blocks []models.RoomRestriction
+	for name := range r.PostForm {
+		if !strings.HasPrefix(name, "add_block_") {
+			continue
+		}
+		exploded := strings.Split(name, "_")
+		if len(exploded) != 4 {
+			helpers.ClientError(w, r, http.StatusBadRequest)
+			return
+		}
+		roomID, err := strconv.Atoi(exploded[2])
+		if _, ok := roomNames[roomID]; err != nil || !ok {
+			helpers.ClientError(w, r, http.StatusBadRequest)
+			return
+		}
+		t, err := time.Parse("2006-01-2", exploded[3])
+		if err != nil {
+			helpers.ClientError(w, r, http.StatusBadRequest)
+			return
+		}
+		blocks = append(blocks, models.RoomRestriction{RoomID: roomID, StartDate: t})
+	}
+
+	form := forms.New(r.PostForm)
+
+	for _, x := range rooms {
+		// get the block map shown to the user from the session; any block in it that is
+		// no longer checked in the posted form is a block we need to remove
+		curMap, _ := m.App.Session.Get(r.Context(), fmt.Sprintf("block_map_%d", x.ID)).(map[string]int)
+		for name, value := range curMap {
+			if value > 0 && !form.Has(fmt.Sprintf("remove_block_%d_%s", x.ID, name)) {
+				err := m.DB.DeleteBlockByID(r.Context(), value)
+				if err != nil {
+					helpers.ServerError(w, r, err)
+					return
+				}
+			}
+		}
+	}
+
+	// handle new blocks, nights booked or blocked meanwhile are left as they are
+	var taken []string
+	for _, b := range blocks {
+		err := m.DB.InsertBlockForRoom(r.Context(), b.RoomID, b.StartDate)
+		if errors.Is(err, repository.ErrRoomUnavailable) {
+			taken = append(taken, fmt.Sprintf("%s on %s", roomNames[b.RoomID], b.StartDate.Format("2006-01-02")))
+			continue
+		}
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+	}
+
+	if len(taken) > 0 {
+		sort.Strings(taken)
+		m.App.Session.Put(r.Context(), "error", "Changes saved, except for the nights already taken: "+strings.Join(taken, ", "))
+	} else {
+		m.App.Session.Put(r.Context(), "flash", "Changes saved")
+	}
+	http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%d&m=%d", year, month), http.StatusSeeOther)
+}
+
+// AdminAPITokens lists the api tokens and shows the form issuing new ones
+func (m *Repository) AdminAPITokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := m.DB.AllAPITokens(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["tokens"] = tokens
+	data["scopes"] = models.Scopes
+
+	// a new token is only ever shown once, right after it was issued
+	stringMap := make(map[string]string)
+	stringMap["new_token"] = m.App.Session.PopString(r.Context(), "new_api_token")
+
+	render.Template(w, r, "admin-api-tokens.page.tmpl", &models.TemplateData{
+		Form:      forms.New(nil),
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
+// AdminPostAPITokens issues a new api token
+func (m *Repository) AdminPostAPITokens(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("name")
+
+	var scopes []string
+	for _, scope := range models.Scopes {
+		if form.Has("scope_" + scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		form.Errors.Add("scopes", "Grant at least one scope.")
+	}
+
+	if !form.Valid() {
+		tokens, err := m.DB.AllAPITokens(r.Context())
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		data := make(map[string]interface{})
+		data["tokens"] = tokens
+		data["scopes"] = models.Scopes
+		render.Template(w, r, "admin-api-tokens.page.tmpl", &models.TemplateData{
+			Form: form,
+			Data: data,
+		})
+		return
+	}
+
+	token, hash, err := helpers.GenerateAPIToken()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	_, err = m.DB.InsertAPIToken(r.Context(), models.APIToken{
+		UserID:    m.App.Session.GetInt(r.Context(), "user_id"),
+		Name:      form.Get("name"),
+		TokenHash: hash,
+		Scopes:    scopes,
+	})
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "new_api_token", token)
+	m.App.Session.Put(r.Context(), "flash", "Token issued")
+	http.Redirect(w, r, "/admin/api-tokens", http.StatusSeeOther)
+}
+
+// AdminDeleteAPIToken revokes an api token
+func (m *Repository) AdminDeleteAPIToken(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	err = m.DB.DeleteAPIToken(r.Context(), id)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Token revoked")
+	http.Redirect(w, r, "/admin/api-tokens", http.StatusSeeOther)
+}
+
+// ratePlanWeekdays are the days of the week a rate plan can be limited to, in the order they are shown
+var ratePlanWeekdays = []time.Weekday{
+	time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday,
+}
+
+// AdminRatePlans lists the rate plans and shows the form adding new ones
+func (m *Repository) AdminRatePlans(w http.ResponseWriter, r *http.Request) {
+	m.renderRatePlans(w, r, forms.New(nil))
+}
+
+// AdminPostRatePlans adds a new rate plan
+func (m *Repository) AdminPostRatePlans(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("name", "room_id", "start_date", "end_date", "rate")
+
+	plan := models.RatePlan{Name: form.Get("name")}
+
+	plan.RoomID, err = strconv.Atoi(form.Get("room_id"))
+	if form.Has("room_id") && err != nil {
+		form.Errors.Add("room_id", "Invalid room.")
+	}
+
+	layout := "2006-01-02"
+	plan.StartDate, err = time.Parse(layout, form.Get("start_date"))
+	if form.Has("start_date") && err != nil {
+		form.Errors.Add("start_date", "Invalid date.")
+	}
+	plan.EndDate, err = time.Parse(layout, form.Get("end_date"))
+	if form.Has("end_date") && err != nil {
+		form.Errors.Add("end_date", "Invalid date.")
+	}
+	if form.Valid() && plan.EndDate.Before(plan.StartDate) {
+		form.Errors.Add("end_date", "The last night must not be before the first one.")
+	}
+
+	plan.NightlyRate, err = pricing.ParseAmount(form.Get("rate"))
+	if form.Has("rate") && err != nil {
+		form.Errors.Add("rate", "Enter a nightly rate in dollars, such as 150 or 149.99.")
+	}
+
+	for _, d := range ratePlanWeekdays {
+		if form.Has("weekday_" + d.String()) {
+			plan.Weekdays = append(plan.Weekdays, d)
+		}
+	}
+
+	if !form.Valid() {
+		m.renderRatePlans(w, r, form)
+		return
+	}
+
+	_, err = m.DB.GetRoomByID(r.Context(), plan.RoomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		form.Errors.Add("room_id", "Invalid room.")
+		m.renderRatePlans(w, r, form)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	_, err = m.DB.InsertRatePlan(r.Context(), plan)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Rate plan added")
+	http.Redirect(w, r, "/admin/rate-plans", http.StatusSeeOther)
+}
+
+// AdminDeleteRatePlan deletes a rate plan
+func (m *Repository) AdminDeleteRatePlan(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	err = m.DB.DeleteRatePlan(r.Context(), id)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Rate plan deleted")
+	http.Redirect(w, r, "/admin/rate-plans", http.StatusSeeOther)
+}
+
+// renderRatePlans renders the rate plans page, with the form adding new ones
+func (m *Repository) renderRatePlans(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+	plans, err := m.DB.AllRatePlans(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["plans"] = plans
+	data["rooms"] = rooms
+	data["weekdays"] = ratePlanWeekdays
+
+	render.Template(w, r, "admin-rate-plans.page.tmpl", &models.TemplateData{
+		Form: form,
+		Data: data,
+	})
+}
+
+type healthResponse struct {
+	Status           string            `json:"status"`
+	Checks           map[string]string `json:"checks,omitempty"`
+	MigrationVersion string            `json:"migration_version,omitempty"`
+}
+
+// Healthz reports that the process is alive
+func (m *Repository) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// Readyz reports whether the application can serve requests, checking the database and the templates.
+// The migration version is only informational, as databases created from the schema dump have none.
+func (m *Repository) Readyz(w http.ResponseWriter, r *http.Request) {
+	resp := healthResponse{
+		Status: "ok",
+		Checks: map[string]string{
+			"database":  "ok",
+			"templates": "ok",
+		},
+	}
+
+	err := m.DB.Ping(r.Context())
+	if err != nil {
+		m.App.Logger.ErrorContext(r.Context(), "database not reachable", "error", err)
+		resp.Status = "unavailable"
+		resp.Checks["database"] = "unreachable"
+	} else {
+		resp.MigrationVersion, err = m.DB.MigrationVersion(r.Context())
+		if err != nil {
+			m.App.Logger.WarnContext(r.Context(), "cannot read migration version", "error", err)
+		}
+	}
+
+	if len(m.App.TemplateCache) == 0 {
+		resp.Status = "unavailable"
+		resp.Checks["templates"] = "not loaded"
+	}
+
+	status := http.StatusOK
+	if resp.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealth(w, status, resp)
+}
+
+// writeHealth writes a health check response as json
+func writeHealth(w http.ResponseWriter, status int, resp healthResponse) {
+	out, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(out)
+}
@@ -3,11 +3,15 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/go-chi/chi/v5"
 	"github.com/tomdim/bookings/internal/models"
+	"github.com/tomdim/bookings/internal/repository"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
@@ -24,12 +28,36 @@ var theTests = []struct {
 	method             string
 	expectedStatusCode int
 }{
+	{"healthz", "/healthz", "GET", http.StatusOK},
+	{"readyz", "/readyz", "GET", http.StatusOK},
 	{"home", "/", "GET", http.StatusOK},
 	{"about", "/about", "GET", http.StatusOK},
 	{"gq", "/generals-quarters", "GET", http.StatusOK},
 	{"ms", "/majors-suite", "GET", http.StatusOK},
 	{"availability", "/search-availability", "GET", http.StatusOK},
 	{"contact", "/contact", "GET", http.StatusOK},
+	{"my reservation", "/my-reservation", "GET", http.StatusOK},
+	{"login", "/user/login", "GET", http.StatusOK},
+	{"logout", "/user/logout", "GET", http.StatusOK},
+	{"dashboard", "/admin/dashboard", "GET", http.StatusOK},
+	{"new res", "/admin/reservations-new", "GET", http.StatusOK},
+	{"all res", "/admin/reservations-all", "GET", http.StatusOK},
+	{"find res not found", "/admin/reservations-find?reference=NOSUCHREF", "GET", http.StatusOK},
+	{"res cal", "/admin/reservations-calendar", "GET", http.StatusOK},
+	{"res cal with params", "/admin/reservations-calendar?y=2050&m=1", "GET", http.StatusOK},
+	{"rate plans", "/admin/rate-plans", "GET", http.StatusOK},
+	{"api tokens", "/admin/api-tokens", "GET", http.StatusOK},
+	{"api rooms", "/api/v1/rooms", "GET", http.StatusOK},
+	{"api room", "/api/v1/rooms/2", "GET", http.StatusOK},
+	{"api room not found", "/api/v1/rooms/99", "GET", http.StatusNotFound},
+	{"api room invalid id", "/api/v1/rooms/x", "GET", http.StatusBadRequest},
+	{"api availability", "/api/v1/availability?start=2050-01-01&end=2050-01-02", "GET", http.StatusOK},
+	{"api availability no dates", "/api/v1/availability", "GET", http.StatusBadRequest},
+	{"api reservation", "/api/v1/reservations/BK-TEST-0001", "GET", http.StatusOK},
+	{"api reservation typed differently", "/api/v1/reservations/bktest0001", "GET", http.StatusOK},
+	{"api reservation with query string", "/api/v1/reservations/BK-TEST-0001?fields=all", "GET", http.StatusOK},
+	{"api reservation not found", "/api/v1/reservations/NOSUCHREF", "GET", http.StatusNotFound},
+	{"api unknown url", "/api/v1/nope", "GET", http.StatusNotFound},
 }
 
 func TestHandlers(t *testing.T) {
@@ -85,6 +113,18 @@ func TestRepository_PostReservation(t *testing.T) {
 		t.Errorf("PostReservation handler returned unexpected response code: got %d, expected %d", rr.Code, http.StatusSeeOther)
 	}
 
+	// the guest is sent a confirmation and the owner a notification
+	for _, to := range []string{"john@smith.com", "owner@example.com"} {
+		select {
+		case mail := <-app.MailChan:
+			if mail.To != to || !strings.Contains(mail.Content, "Quarters") {
+				t.Errorf("PostReservation queued unexpected mail to %s: %s", mail.To, mail.Subject)
+			}
+		default:
+			t.Errorf("PostReservation did not queue a mail to %s", to)
+		}
+	}
+
 	// test case reservation is not in the session (reset everything)
 	req, _ = http.NewRequest("POST", "/make-reservation", strings.NewReader(reqBody))
 	ctx = getCtx(req)
@@ -167,13 +207,39 @@ func TestRepository_PostReservation(t *testing.T) {
 	if rr.Code != http.StatusTemporaryRedirect {
 		t.Errorf("PostReservation handler returned unexpected response code for failed room restriction insertion: got %d, expected %d", rr.Code, http.StatusTemporaryRedirect)
 	}
+
+	// test for room taken by a concurrent booking
+	req, _ = http.NewRequest("POST", "/make-reservation", strings.NewReader(reqBody))
+	ctx = getCtx(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rr = httptest.NewRecorder()
+	reservation.RoomID = 3
+	reservation.Room.ID = 3
+	session.Put(ctx, "reservation", reservation)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("PostReservation handler returned unexpected response code for room just taken: got %d, expected %d", rr.Code, http.StatusSeeOther)
+	}
+	actualLoc, _ := rr.Result().Location()
+	if actualLoc.String() != "/search-availability" {
+		t.Errorf("PostReservation handler redirected to unexpected location for room just taken: got %s, expected %s", actualLoc.String(), "/search-availability")
+	}
 }
 
 func TestRepository_Reservation(t *testing.T) {
+	layout := "2006-01-02"
+	startDate, _ := time.Parse(layout, "2050-01-01")
+	endDate, _ := time.Parse(layout, "2050-01-03")
+
 	reservation := models.Reservation{
-		RoomID: 1,
+		StartDate: startDate,
+		EndDate:   endDate,
+		RoomID:    2,
 		Room: models.Room{
-			ID:       1,
+			ID:       2,
 			RoomName: "General's Quarters",
 		},
 	}
@@ -191,6 +257,10 @@ func TestRepository_Reservation(t *testing.T) {
 	if rr.Code != http.StatusOK {
 		t.Errorf("Reservation handler returned unexpected response code: got %d, expected %d", rr.Code, http.StatusOK)
 	}
+	// two nights of the General's Quarters at $120.00
+	if !strings.Contains(rr.Body.String(), "$240.00") {
+		t.Error("expected the reservation page to show the price of the stay")
+	}
 
 	// test case reservation is not in the session (reset everything)
 	req, _ = http.NewRequest("GET", "/make-reservation", nil)
@@ -215,14 +285,50 @@ func TestRepository_Reservation(t *testing.T) {
 	if rr.Code != http.StatusTemporaryRedirect {
 		t.Errorf("Reservation handler returned unexpected response code: got %d, expected %d", rr.Code, http.StatusTemporaryRedirect)
 	}
+
+	// test with a stay that cannot be priced
+	req, _ = http.NewRequest("GET", "/make-reservation", nil)
+	ctx = getCtx(req)
+	req = req.WithContext(ctx)
+	rr = httptest.NewRecorder()
+	reservation.RoomID = 2
+	reservation.EndDate = reservation.StartDate
+	session.Put(ctx, "reservation", reservation)
+
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusTemporaryRedirect {
+		t.Errorf("Reservation handler returned unexpected response code: got %d, expected %d", rr.Code, http.StatusTemporaryRedirect)
+	}
+
+	// test with an error getting the rate plans
+	req, _ = http.NewRequest("GET", "/make-reservation", nil)
+	ctx = getCtx(req)
+	req = req.WithContext(ctx)
+	rr = httptest.NewRecorder()
+	reservation.StartDate, _ = time.Parse(layout, "2001-01-01")
+	reservation.EndDate, _ = time.Parse(layout, "2001-01-02")
+	session.Put(ctx, "reservation", reservation)
+
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusTemporaryRedirect {
+		t.Errorf("Reservation handler returned unexpected response code: got %d, expected %d", rr.Code, http.StatusTemporaryRedirect)
+	}
 }
 
 func TestRepository_ReservationSummary(t *testing.T) {
+	layout := "2006-01-02"
+	startDate, _ := time.Parse(layout, "2050-01-01")
+	endDate, _ := time.Parse(layout, "2050-01-04")
+
 	reservation := models.Reservation{
-		RoomID: 1,
+		StartDate: startDate,
+		EndDate:   endDate,
+		RoomID:    1,
+		Reference: "BK-TEST-0001",
 		Room: models.Room{
-			ID:       1,
-			RoomName: "General's Quarters",
+			ID:          1,
+			RoomName:    "General's Quarters",
+			NightlyRate: 12000,
 		},
 	}
 
@@ -239,6 +345,12 @@ func TestRepository_ReservationSummary(t *testing.T) {
 	if rr.Code != http.StatusOK {
 		t.Errorf("Reservation summary handler returned unexpected response code: got %d, expected %d", rr.Code, http.StatusOK)
 	}
+	if !strings.Contains(rr.Body.String(), "BK-TEST-0001") {
+		t.Error("expected the reservation summary to show the reservation reference")
+	}
+	if !strings.Contains(rr.Body.String(), "$360.00") {
+		t.Error("expected the reservation summary to show the price of the stay")
+	}
 
 	// test case reservation summary reservation is not in the session
 	req, _ = http.NewRequest("GET", "/make-reservation", nil)
@@ -349,6 +461,29 @@ func TestRepository_AvailabilityJSON(t *testing.T) {
 		t.Errorf("json response message - invalid end date test case: expected `%s`, got `%s`", "Invalid end date format", j.Message)
 	}
 
+	// departure before arrival test case
+	reqBody = "start=2050-05-02"
+	reqBody = fmt.Sprintf("%s&%s", reqBody, "end=2050-05-01")
+	reqBody = fmt.Sprintf("%s&%s", reqBody, "room_id=2")
+
+	req, _ = http.NewRequest("POST", "/search-availability-json", strings.NewReader(reqBody))
+	ctx = getCtx(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	err = json.Unmarshal([]byte(rr.Body.String()), &j)
+	if err != nil {
+		t.Error("failed to parse json response")
+	}
+	if j.OK {
+		t.Error("json response ok - departure before arrival test case: expected false but got true")
+	}
+	if j.Message != "The departure date must be after the arrival date" {
+		t.Errorf("json response message - departure before arrival test case: expected `%s`, got `%s`", "The departure date must be after the arrival date", j.Message)
+	}
+
 	// invalid room id test case
 	reqBody = "start=2050-05-01"
 	reqBody = fmt.Sprintf("%s&%s", reqBody, "end=2050-05-02")
@@ -453,6 +588,32 @@ func TestRepository_AvailabilityJSON(t *testing.T) {
 	if j.RoomID != "2" {
 		t.Errorf("json response room id - happy path test case: expected `%s`, got `%s`", "2", j.RoomID)
 	}
+	if j.Quote == nil || j.Quote.Nights != 1 || j.Quote.Total != 12000 {
+		t.Errorf("json response quote - happy path test case: expected 1 night for 12000, got %+v", j.Quote)
+	}
+}
+
+func TestRepository_AvailabilityJSON_RatePlans(t *testing.T) {
+	// a friday and a saturday night of the summer, both charged at the summer weekends rate
+	reqBody := "start=2050-07-01&end=2050-07-03&room_id=2"
+
+	req, _ := http.NewRequest("POST", "/search-availability-json", strings.NewReader(reqBody))
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(Repo.AvailabilityJSON)
+	handler.ServeHTTP(rr, req)
+
+	var j jsonResponse
+	err := json.Unmarshal([]byte(rr.Body.String()), &j)
+	if err != nil {
+		t.Fatal("failed to parse json response")
+	}
+	if j.Quote == nil || j.Quote.Total != 40000 || len(j.Quote.Lines) != 1 || j.Quote.Lines[0].Name != "Summer weekends" {
+		t.Errorf("expected 2 nights at the summer weekends rate for 40000, got %+v", j.Quote)
+	}
 }
 
 func TestRepository_PostAvailability(t *testing.T) {
@@ -472,6 +633,25 @@ func TestRepository_PostAvailability(t *testing.T) {
 	if rr.Code != http.StatusOK {
 		t.Errorf("PostAvailability handler returned unexpected response code: got %d, expected %d", rr.Code, http.StatusOK)
 	}
+	if !strings.Contains(rr.Body.String(), "$100.00") {
+		t.Error("expected the available rooms to show the price of the stay")
+	}
+
+	// departure before arrival test case
+	reqBody = "start=2050-01-02"
+	reqBody = fmt.Sprintf("%s&%s", reqBody, "end=2050-01-01")
+
+	req, _ = http.NewRequest("POST", "/search-availability", strings.NewReader(reqBody))
+	ctx = getCtx(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("PostAvailability handler returned unexpected response code: got %d, expected %d", rr.Code, http.StatusSeeOther)
+	}
 
 	// invalid (missing) post form data
 	req, _ = http.NewRequest("POST", "/search-availability", nil)
@@ -690,6 +870,715 @@ func TestRepository_ChooseRoom(t *testing.T) {
 	}
 }
 
+var loginTests = []struct {
+	name               string
+	email              string
+	password           string
+	expectedStatusCode int
+	expectedHTML       string
+	expectedLocation   string
+}{
+	{"valid-credentials", "me@here.ca", "password", http.StatusSeeOther, "", "/"},
+	{"invalid-credentials", "jack@nimble.com", "password", http.StatusSeeOther, "", "/user/login"},
+	{"wrong-password", "me@here.ca", "wrong", http.StatusSeeOther, "", "/user/login"},
+	{"invalid-data", "j", "", http.StatusOK, `action="/user/login"`, ""},
+}
+
+func TestRepository_PostShowLogin(t *testing.T) {
+	for _, e := range loginTests {
+		postedData := url.Values{}
+		postedData.Add("email", e.email)
+		postedData.Add("password", e.password)
+
+		req, _ := http.NewRequest("POST", "/user/login", strings.NewReader(postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.PostShowLogin)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got %s", e.name, e.expectedLocation, actualLoc.String())
+			}
+		}
+
+		if e.expectedHTML != "" {
+			html := rr.Body.String()
+			if !strings.Contains(html, e.expectedHTML) {
+				t.Errorf("failed %s: expected to find %s but did not", e.name, e.expectedHTML)
+			}
+		}
+	}
+}
+
+var adminShowReservationTests = []struct {
+	name               string
+	url                string
+	expectedStatusCode int
+}{
+	{"valid", "/admin/reservations/new/1", http.StatusOK},
+	{"with query string", "/admin/reservations/cal/1?y=2050&m=1", http.StatusOK},
+	{"invalid id", "/admin/reservations/new/invalid", http.StatusBadRequest},
+	{"unknown source", "/admin/reservations/find/1", http.StatusBadRequest},
+	{"not found", "/admin/reservations/all/99", http.StatusNotFound},
+	{"db error", "/admin/reservations/all/3", http.StatusInternalServerError},
+}
+
+func TestRepository_AdminShowReservation(t *testing.T) {
+	for _, e := range adminShowReservationTests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		ctx := withRoute(getCtx(req), req, "/admin/reservations/{src}/{id}")
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.AdminShowReservation)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+var adminFindReservationTests = []struct {
+	name             string
+	url              string
+	expectedLocation string
+}{
+	{"valid", "/admin/reservations-find?reference=BK-TEST-0001", "/admin/reservations/all/1"},
+	{"typed differently", "/admin/reservations-find?reference=bk+test+oo01", "/admin/reservations/all/1"},
+	{"missing reference", "/admin/reservations-find", "/admin/dashboard"},
+	{"unknown reference", "/admin/reservations-find?reference=NOSUCHREF", "/admin/dashboard"},
+}
+
+func TestRepository_AdminFindReservation(t *testing.T) {
+	for _, e := range adminFindReservationTests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.AdminFindReservation)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, http.StatusSeeOther, rr.Code)
+		}
+		actualLoc, _ := rr.Result().Location()
+		if actualLoc.String() != e.expectedLocation {
+			t.Errorf("failed %s: expected location %s, but got %s", e.name, e.expectedLocation, actualLoc.String())
+		}
+	}
+
+	// a database error is a server error
+	req, _ := http.NewRequest("GET", "/admin/reservations-find?reference=BK-TEST-ERR1", nil)
+	req = req.WithContext(getCtx(req))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.AdminFindReservation).ServeHTTP(rr, req)
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("failed database error: expected code %d, but got %d", http.StatusInternalServerError, rr.Code)
+	}
+}
+
+var adminPostShowReservationTests = []struct {
+	name               string
+	url                string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedLocation   string
+}{
+	{
+		"valid",
+		"/admin/reservations/new/1",
+		url.Values{
+			"first_name": {"John"},
+			"last_name":  {"Smith"},
+			"email":      {"john@smith.com"},
+			"phone":      {"123456789"},
+		},
+		http.StatusSeeOther,
+		"/admin/reservations-new",
+	},
+	{
+		"with query string",
+		"/admin/reservations/cal/1?y=2050&m=1",
+		url.Values{
+			"first_name": {"John"},
+			"last_name":  {"Smith"},
+			"email":      {"john@smith.com"},
+			"phone":      {"123456789"},
+		},
+		http.StatusSeeOther,
+		"/admin/reservations-calendar",
+	},
+	{
+		"invalid form",
+		"/admin/reservations/all/1",
+		url.Values{
+			"first_name": {"J"},
+			"last_name":  {"Smith"},
+			"email":      {"john"},
+			"phone":      {"123456789"},
+		},
+		http.StatusOK,
+		"",
+	},
+	{
+		"invalid id",
+		"/admin/reservations/all/invalid",
+		url.Values{},
+		http.StatusBadRequest,
+		"",
+	},
+	{
+		"unknown source",
+		"/admin/reservations/find/1",
+		url.Values{},
+		http.StatusBadRequest,
+		"",
+	},
+	{
+		"reservation not found",
+		"/admin/reservations/all/99",
+		url.Values{},
+		http.StatusNotFound,
+		"",
+	},
+	{
+		"db error",
+		"/admin/reservations/all/3",
+		url.Values{},
+		http.StatusInternalServerError,
+		"",
+	},
+	{
+		"update error",
+		"/admin/reservations/all/2",
+		url.Values{
+			"first_name": {"John"},
+			"last_name":  {"Smith"},
+			"email":      {"john@smith.com"},
+			"phone":      {"123456789"},
+		},
+		http.StatusInternalServerError,
+		"",
+	},
+}
+
+func TestRepository_AdminPostShowReservation(t *testing.T) {
+	for _, e := range adminPostShowReservationTests {
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(e.postedData.Encode()))
+		ctx := withRoute(getCtx(req), req, "/admin/reservations/{src}/{id}")
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.AdminPostShowReservation)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got %s", e.name, e.expectedLocation, actualLoc.String())
+			}
+		}
+	}
+}
+
+var adminDeleteReservationTests = []struct {
+	name               string
+	url                string
+	expectedStatusCode int
+}{
+	{"valid", "/admin/reservations/all/1/delete", http.StatusSeeOther},
+	{"invalid id", "/admin/reservations/all/invalid/delete", http.StatusBadRequest},
+	{"unknown source", "/admin/reservations/find/1/delete", http.StatusBadRequest},
+	{"delete error", "/admin/reservations/new/2/delete", http.StatusInternalServerError},
+}
+
+func TestRepository_AdminDeleteReservation(t *testing.T) {
+	for _, e := range adminDeleteReservationTests {
+		req, _ := http.NewRequest("POST", e.url, nil)
+		ctx := withRoute(getCtx(req), req, "/admin/reservations/{src}/{id}/delete")
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.AdminDeleteReservation)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+var adminProcessReservationTests = []struct {
+	name               string
+	url                string
+	processed          string
+	expectedStatusCode int
+}{
+	{"mark processed", "/admin/reservations/new/1/processed", "1", http.StatusSeeOther},
+	{"mark unprocessed", "/admin/reservations/all/1/processed", "0", http.StatusSeeOther},
+	{"invalid id", "/admin/reservations/all/invalid/processed", "1", http.StatusBadRequest},
+	{"unknown source", "/admin/reservations/find/1/processed", "1", http.StatusBadRequest},
+	{"update error", "/admin/reservations/new/2/processed", "1", http.StatusInternalServerError},
+}
+
+func TestRepository_AdminProcessReservation(t *testing.T) {
+	for _, e := range adminProcessReservationTests {
+		postedData := url.Values{}
+		postedData.Add("processed", e.processed)
+
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(postedData.Encode()))
+		ctx := withRoute(getCtx(req), req, "/admin/reservations/{src}/{id}/processed")
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.AdminProcessReservation)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+var adminPostReservationsCalendarTests = []struct {
+	name               string
+	block              string
+	removedBlockID     int
+	expectedStatusCode int
+	expectedFlash      bool
+}{
+	// the block of the 4th of the month was shown, but is not posted back, so it gets removed
+	{"valid", "add_block_1_2050-01-10", 2, http.StatusSeeOther, true},
+	{"night taken", "add_block_1_2050-01-20", 2, http.StatusSeeOther, false},
+	{"malformed name", "add_block_1", 2, http.StatusBadRequest, false},
+	{"invalid room", "add_block_x_2050-01-10", 2, http.StatusBadRequest, false},
+	{"unknown room", "add_block_99_2050-01-10", 2, http.StatusBadRequest, false},
+	{"invalid date", "add_block_1_2050-13-10", 2, http.StatusBadRequest, false},
+	{"insert error", "add_block_1_2050-01-21", 2, http.StatusInternalServerError, false},
+	{"delete error", "add_block_1_2050-01-10", 3, http.StatusInternalServerError, false},
+}
+
+func TestRepository_AdminPostReservationsCalendar(t *testing.T) {
+	for _, e := range adminPostReservationsCalendarTests {
+		postedData := url.Values{}
+		postedData.Add("y", "2050")
+		postedData.Add("m", "1")
+		postedData.Add(e.block, "1")
+
+		req, _ := http.NewRequest("POST", "/admin/reservations-calendar", strings.NewReader(postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		blockMap := make(map[string]int)
+		blockMap["2050-01-4"] = e.removedBlockID
+		blockMap["2050-01-5"] = 0
+		session.Put(ctx, "block_map_1", blockMap)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.AdminPostReservationsCalendar)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+		if rr.Code != http.StatusSeeOther {
+			continue
+		}
+
+		actualLoc, _ := rr.Result().Location()
+		if actualLoc.String() != "/admin/reservations-calendar?y=2050&m=1" {
+			t.Errorf("failed %s: redirected to unexpected location: got %s", e.name, actualLoc.String())
+		}
+		if flash := session.GetString(ctx, "flash"); (flash != "") != e.expectedFlash {
+			t.Errorf("failed %s: unexpected flash %q, with error %q", e.name, flash, session.GetString(ctx, "error"))
+		}
+	}
+}
+
+// noMigrationsRepo is a database without the schema_migration table, as when created from the schema dump
+type noMigrationsRepo struct {
+	repository.DatabaseRepo
+}
+
+func (noMigrationsRepo) MigrationVersion(ctx context.Context) (string, error) {
+	return "", errors.New(`relation "schema_migration" does not exist`)
+}
+
+func TestRepository_Readyz(t *testing.T) {
+	var h healthResponse
+	handler := http.HandlerFunc(Repo.Readyz)
+
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Readyz handler returned unexpected response code: got %d, expected %d", rr.Code, http.StatusOK)
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &h)
+	if err != nil {
+		t.Error("failed to parse json response")
+	}
+	if h.Status != "ok" {
+		t.Errorf("Readyz handler returned unexpected status: got %s, expected ok", h.Status)
+	}
+	if h.MigrationVersion != "20261018100000" {
+		t.Errorf("Readyz handler returned unexpected migration version: got %s", h.MigrationVersion)
+	}
+
+	// the migration version cannot be read, which does not make the app unavailable
+	repo := &Repository{App: &app, DB: noMigrationsRepo{Repo.DB}}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(repo.Readyz).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Readyz handler returned unexpected response code without migrations: got %d, expected %d", rr.Code, http.StatusOK)
+	}
+	h = healthResponse{}
+	err = json.Unmarshal(rr.Body.Bytes(), &h)
+	if err != nil {
+		t.Error("failed to parse json response")
+	}
+	if h.Status != "ok" || h.MigrationVersion != "" {
+		t.Errorf("Readyz handler returned unexpected status %s and migration version %q without migrations", h.Status, h.MigrationVersion)
+	}
+
+	// templates not loaded test case
+	tc := app.TemplateCache
+	app.TemplateCache = nil
+	defer func() { app.TemplateCache = tc }()
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Readyz handler returned unexpected response code without templates: got %d, expected %d", rr.Code, http.StatusServiceUnavailable)
+	}
+	err = json.Unmarshal(rr.Body.Bytes(), &h)
+	if err != nil {
+		t.Error("failed to parse json response")
+	}
+	if h.Checks["templates"] != "not loaded" {
+		t.Errorf("Readyz handler returned unexpected templates check: got %s", h.Checks["templates"])
+	}
+}
+
+var postMyReservationTests = []struct {
+	name               string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedCancelForm bool
+}{
+	{"valid", url.Values{"reference": {"BK-TEST-0001"}, "email": {"john@smith.com"}}, http.StatusOK, true},
+	{"typed differently", url.Values{"reference": {" bk test-oo01"}, "email": {"John@Smith.com"}}, http.StatusOK, true},
+	{"past cancel deadline", url.Values{"reference": {"BK-TEST-0002"}, "email": {"john@smith.com"}}, http.StatusOK, false},
+	{"already cancelled", url.Values{"reference": {"BK-TEST-0004"}, "email": {"john@smith.com"}}, http.StatusOK, false},
+	{"missing email", url.Values{"reference": {"BK-TEST-0001"}}, http.StatusOK, false},
+	{"wrong email", url.Values{"reference": {"BK-TEST-0001"}, "email": {"jane@smith.com"}}, http.StatusSeeOther, false},
+	{"unknown reference", url.Values{"reference": {"NOSUCHREF"}, "email": {"john@smith.com"}}, http.StatusSeeOther, false},
+	{"database error", url.Values{"reference": {"BK-TEST-ERR1"}, "email": {"john@smith.com"}}, http.StatusSeeOther, false},
+}
+
+func TestRepository_PostMyReservation(t *testing.T) {
+	for _, e := range postMyReservationTests {
+		req, _ := http.NewRequest("POST", "/my-reservation", strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.PostMyReservation)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+		if hasForm := strings.Contains(rr.Body.String(), "/my-reservation/cancel"); hasForm != e.expectedCancelForm {
+			t.Errorf("failed %s: expected cancel form to be shown to be %t", e.name, e.expectedCancelForm)
+		}
+	}
+}
+
+var postCancelMyReservationTests = []struct {
+	name               string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedLocation   string
+}{
+	{"valid", url.Values{"reference": {"BK-TEST-0001"}, "email": {"john@smith.com"}}, http.StatusSeeOther, "/"},
+	{"past cancel deadline", url.Values{"reference": {"BK-TEST-0002"}, "email": {"john@smith.com"}}, http.StatusOK, ""},
+	{"already cancelled", url.Values{"reference": {"BK-TEST-0004"}, "email": {"john@smith.com"}}, http.StatusOK, ""},
+	{"wrong email", url.Values{"reference": {"BK-TEST-0001"}, "email": {"jane@smith.com"}}, http.StatusSeeOther, "/my-reservation"},
+	{"cancel error", url.Values{"reference": {"BK-TEST-0003"}, "email": {"john@smith.com"}}, http.StatusSeeOther, "/my-reservation"},
+}
+
+func TestRepository_PostCancelMyReservation(t *testing.T) {
+	for _, e := range postCancelMyReservationTests {
+		req, _ := http.NewRequest("POST", "/my-reservation/cancel", strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.PostCancelMyReservation)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+		if e.expectedLocation != "" && rr.Header().Get("Location") != e.expectedLocation {
+			t.Errorf("failed %s: expected location %s, but got %s", e.name, e.expectedLocation, rr.Header().Get("Location"))
+		}
+	}
+
+	// only the valid cancellation was notified to the owner
+	select {
+	case mail := <-app.MailChan:
+		if mail.To != "owner@example.com" || mail.Subject != "Reservation cancelled" {
+			t.Errorf("unexpected mail queued to %s: %s", mail.To, mail.Subject)
+		}
+	default:
+		t.Error("expected the cancellation to be notified to the owner")
+	}
+	if len(app.MailChan) != 0 {
+		t.Errorf("expected a single mail queued, got %d more", len(app.MailChan))
+	}
+}
+
+func TestRepository_Forbidden(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(Repo.Forbidden)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Forbidden handler returned unexpected response code: got %d, expected %d", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestRepository_TooManyRequests(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/make-reservation", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(Repo.TooManyRequests)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("TooManyRequests handler returned unexpected response code: got %d, expected %d", rr.Code, http.StatusTooManyRequests)
+	}
+
+	// the availability json endpoint gets a json response its script can parse
+	req, _ = http.NewRequest("POST", "/search-availability-json", nil)
+	rr = httptest.NewRecorder()
+	handler = http.HandlerFunc(Repo.JSONTooManyRequests)
+	handler.ServeHTTP(rr, req)
+
+	var j jsonResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &j); err != nil {
+		t.Fatal("failed to parse json")
+	}
+	if rr.Code != http.StatusTooManyRequests || j.OK {
+		t.Errorf("JSONTooManyRequests handler returned unexpected response: got %d and ok %t", rr.Code, j.OK)
+	}
+}
+
+var adminPostAPITokensTests = []struct {
+	name               string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedNewToken   bool
+}{
+	{"valid", url.Values{"name": {"Partner"}, "scope_availability:read": {"1"}}, http.StatusSeeOther, true},
+	{"missing name", url.Values{"scope_availability:read": {"1"}}, http.StatusOK, false},
+	{"missing scopes", url.Values{"name": {"Partner"}}, http.StatusOK, false},
+	{"insert error", url.Values{"name": {"fail"}, "scope_reservations:write": {"1"}}, http.StatusInternalServerError, false},
+}
+
+func TestRepository_AdminPostAPITokens(t *testing.T) {
+	for _, e := range adminPostAPITokensTests {
+		req, _ := http.NewRequest("POST", "/admin/api-tokens", strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.AdminPostAPITokens)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		token := session.GetString(ctx, "new_api_token")
+		if e.expectedNewToken && !strings.HasPrefix(token, "bk_") {
+			t.Errorf("failed %s: expected the new token in session, got %q", e.name, token)
+		}
+		if !e.expectedNewToken && token != "" {
+			t.Errorf("failed %s: expected no new token in session, got %q", e.name, token)
+		}
+	}
+}
+
+var adminDeleteAPITokenTests = []struct {
+	name               string
+	url                string
+	expectedStatusCode int
+}{
+	{"valid", "/admin/api-tokens/1/delete", http.StatusSeeOther},
+	{"invalid id", "/admin/api-tokens/invalid/delete", http.StatusBadRequest},
+	{"delete error", "/admin/api-tokens/2/delete", http.StatusInternalServerError},
+}
+
+func TestRepository_AdminDeleteAPIToken(t *testing.T) {
+	for _, e := range adminDeleteAPITokenTests {
+		req, _ := http.NewRequest("POST", e.url, nil)
+		ctx := withRoute(getCtx(req), req, "/admin/api-tokens/{id}/delete")
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.AdminDeleteAPIToken)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+var adminPostRatePlansTests = []struct {
+	name               string
+	postedData         url.Values
+	expectedStatusCode int
+}{
+	{
+		"valid",
+		url.Values{"name": {"Summer"}, "room_id": {"2"}, "start_date": {"2050-06-01"}, "end_date": {"2050-08-31"}, "rate": {"180"}},
+		http.StatusSeeOther,
+	},
+	{
+		"valid with weekdays",
+		url.Values{"name": {"Weekends"}, "room_id": {"2"}, "start_date": {"2050-01-01"}, "end_date": {"2050-12-31"}, "rate": {"$160.50"},
+			"weekday_Friday": {"1"}, "weekday_Saturday": {"1"}},
+		http.StatusSeeOther,
+	},
+	{
+		"single night",
+		url.Values{"name": {"New year"}, "room_id": {"2"}, "start_date": {"2050-12-31"}, "end_date": {"2050-12-31"}, "rate": {"300"}},
+		http.StatusSeeOther,
+	},
+	{
+		"missing fields",
+		url.Values{"name": {"Summer"}},
+		http.StatusOK,
+	},
+	{
+		"invalid date",
+		url.Values{"name": {"Summer"}, "room_id": {"2"}, "start_date": {"invalid"}, "end_date": {"2050-08-31"}, "rate": {"180"}},
+		http.StatusOK,
+	},
+	{
+		"last night before first",
+		url.Values{"name": {"Summer"}, "room_id": {"2"}, "start_date": {"2050-08-31"}, "end_date": {"2050-06-01"}, "rate": {"180"}},
+		http.StatusOK,
+	},
+	{
+		"invalid rate",
+		url.Values{"name": {"Summer"}, "room_id": {"2"}, "start_date": {"2050-06-01"}, "end_date": {"2050-08-31"}, "rate": {"-5"}},
+		http.StatusOK,
+	},
+	{
+		"unknown room",
+		url.Values{"name": {"Summer"}, "room_id": {"99"}, "start_date": {"2050-06-01"}, "end_date": {"2050-08-31"}, "rate": {"180"}},
+		http.StatusOK,
+	},
+	{
+		"room error",
+		url.Values{"name": {"Summer"}, "room_id": {"3"}, "start_date": {"2050-06-01"}, "end_date": {"2050-08-31"}, "rate": {"180"}},
+		http.StatusInternalServerError,
+	},
+	{
+		"insert error",
+		url.Values{"name": {"fail"}, "room_id": {"2"}, "start_date": {"2050-06-01"}, "end_date": {"2050-08-31"}, "rate": {"180"}},
+		http.StatusInternalServerError,
+	},
+}
+
+func TestRepository_AdminPostRatePlans(t *testing.T) {
+	for _, e := range adminPostRatePlansTests {
+		req, _ := http.NewRequest("POST", "/admin/rate-plans", strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.AdminPostRatePlans)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+var adminDeleteRatePlanTests = []struct {
+	name               string
+	url                string
+	expectedStatusCode int
+}{
+	{"valid", "/admin/rate-plans/1/delete", http.StatusSeeOther},
+	{"invalid id", "/admin/rate-plans/invalid/delete", http.StatusBadRequest},
+	{"delete error", "/admin/rate-plans/2/delete", http.StatusInternalServerError},
+}
+
+func TestRepository_AdminDeleteRatePlan(t *testing.T) {
+	for _, e := range adminDeleteRatePlanTests {
+		req, _ := http.NewRequest("POST", e.url, nil)
+		ctx := withRoute(getCtx(req), req, "/admin/rate-plans/{id}/delete")
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.AdminDeleteRatePlan)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+// withRoute returns ctx carrying the url parameters of req, as chi parses them when serving req
+// under the pattern
+func withRoute(ctx context.Context, req *http.Request, pattern string) context.Context {
+	rctx := chi.NewRouteContext()
+	mux := chi.NewRouter()
+	mux.Handle(pattern, http.NotFoundHandler())
+	mux.Match(rctx, req.Method, req.URL.Path)
+	return context.WithValue(ctx, chi.RouteCtxKey, rctx)
+}
+
 func getCtx(req *http.Request) context.Context {
 	ctx, err := session.Load(req.Context(), req.Header.Get("X-Session"))
 	if err != nil {
@@ -7,10 +7,14 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/tomdim/bookings/internal/config"
+	"github.com/tomdim/bookings/internal/helpers"
+	"github.com/tomdim/bookings/internal/logging"
 	"github.com/tomdim/bookings/internal/models"
+	"github.com/tomdim/bookings/internal/pricing"
 	"github.com/tomdim/bookings/internal/render"
 	"html/template"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -21,20 +25,23 @@ import (
 var app config.AppConfig
 var session *scs.SessionManager
 var pathToTemplates = "./../../templates"
-var functions = template.FuncMap{}
+var functions = template.FuncMap{
+	"humanDate":  render.HumanDate,
+	"formatDate": render.FormatDate,
+	"iterate":    render.Iterate,
+	"add":        render.Add,
+	"price":      pricing.Format,
+}
 
 func TestMain(m *testing.M) {
 	// what am I going to put in the session
 	gob.Register(models.Reservation{})
+	gob.Register(map[string]int{})
 
 	// Change this to true when in production
 	app.InProduction = false
 
-	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
-	app.InfoLog = infoLog
-
-	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
-	app.ErrorLog = errorLog
+	app.Logger = logging.New(os.Stdout, slog.LevelInfo)
 
 	session = scs.New()
 	session.Lifetime = 24 * time.Hour
@@ -44,6 +51,12 @@ func TestMain(m *testing.M) {
 
 	app.Session = session
 
+	// mails are queued but not sent, so that tests can check them
+	app.MailChan = make(chan models.MailData, 100)
+	app.MailFrom = "bookings@example.com"
+	app.MailOwner = "owner@example.com"
+	app.CancelDeadline = 48 * time.Hour
+
 	tc, err := CreateTestTemplateCache()
 	if err != nil {
 		log.Fatal("cannot create template cache")
@@ -55,6 +68,7 @@ func TestMain(m *testing.M) {
 	repo := NewTestRepo(&app)
 	NewHandlers(repo)
 	render.NewRenderer(&app)
+	helpers.NewHelpers(&app)
 
 	os.Exit(m.Run())
 }
@@ -66,6 +80,21 @@ func getRoutes() http.Handler {
 	mux.Use(middleware.Recoverer)
 	mux.Use(SessionLoad)
 
+	mux.Get("/healthz", http.HandlerFunc(Repo.Healthz))
+	mux.Get("/readyz", http.HandlerFunc(Repo.Readyz))
+
+	mux.Route("/api/v1", func(mux chi.Router) {
+		mux.Use(testAPIToken)
+		mux.NotFound(Repo.APINotFound)
+		mux.MethodNotAllowed(Repo.APIMethodNotAllowed)
+
+		mux.Get("/rooms", Repo.APIRooms)
+		mux.Get("/rooms/{id}", Repo.APIRoom)
+		mux.Get("/availability", Repo.APIAvailability)
+		mux.Post("/reservations", Repo.APIPostReservation)
+		mux.Get("/reservations/{ref}", Repo.APIReservation)
+	})
+
 	mux.Get("/", http.HandlerFunc(Repo.Home))
 	mux.Get("/about", http.HandlerFunc(Repo.About))
 	mux.Get("/contact", http.HandlerFunc(Repo.Contact))
@@ -79,6 +108,19 @@ func getRoutes() http.Handler {
 	mux.Get("/make-reservation", http.HandlerFunc(Repo.Reservation))
 	mux.Post("/make-reservation", http.HandlerFunc(Repo.PostReservation))
 	mux.Get("/reservation-summary", http.HandlerFunc(Repo.ReservationSummary))
+	mux.Get("/my-reservation", http.HandlerFunc(Repo.MyReservation))
+
+	mux.Get("/user/login", http.HandlerFunc(Repo.ShowLogin))
+	mux.Post("/user/login", http.HandlerFunc(Repo.PostShowLogin))
+	mux.Get("/user/logout", http.HandlerFunc(Repo.Logout))
+
+	mux.Get("/admin/dashboard", http.HandlerFunc(Repo.AdminDashboard))
+	mux.Get("/admin/reservations-new", http.HandlerFunc(Repo.AdminNewReservations))
+	mux.Get("/admin/reservations-all", http.HandlerFunc(Repo.AdminAllReservations))
+	mux.Get("/admin/reservations-find", http.HandlerFunc(Repo.AdminFindReservation))
+	mux.Get("/admin/reservations-calendar", http.HandlerFunc(Repo.AdminReservationsCalendar))
+	mux.Get("/admin/rate-plans", http.HandlerFunc(Repo.AdminRatePlans))
+	mux.Get("/admin/api-tokens", http.HandlerFunc(Repo.AdminAPITokens))
 
 	fileServer := http.FileServer(http.Dir("./static/"))
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
@@ -91,13 +133,24 @@ func SessionLoad(next http.Handler) http.Handler {
 	return session.LoadAndSave(next)
 }
 
+// testAPIToken authenticates the api requests with the reservations test token
+func testAPIToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(helpers.WithAPIToken(r.Context(), models.APIToken{ID: 2})))
+	})
+}
+
 func CreateTestTemplateCache() (map[string]*template.Template, error) {
 	templateCache := map[string]*template.Template{}
 	pages, err := filepath.Glob(fmt.Sprintf("%s/*.page.tmpl", pathToTemplates))
 	if err != nil {
 		return templateCache, err
 	}
-	for _, page := range pages {
+	mails, err := filepath.Glob(fmt.Sprintf("%s/*.mail.tmpl", pathToTemplates))
+	if err != nil {
+		return templateCache, err
+	}
+	for _, page := range append(pages, mails...) {
 		name := filepath.Base(page)
 		ts, err := template.New(name).Funcs(functions).ParseFiles(page)
 		if err != nil {
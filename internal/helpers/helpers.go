@@ -1,12 +1,22 @@
 package helpers
 
 import (
-	"fmt"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"github.com/tomdim/bookings/internal/config"
+	"github.com/tomdim/bookings/internal/models"
 	"net/http"
 	"runtime/debug"
 )
 
+// apiTokenPrefix starts every api token, so that leaked tokens are easy to recognize
+const apiTokenPrefix = "bk_"
+
+type apiTokenKey struct{}
+
 var app *config.AppConfig
 
 // NewHelpers sets up app config for helpers
@@ -14,13 +24,49 @@ func NewHelpers(a *config.AppConfig) {
 	app = a
 }
 
-func ClientError(w http.ResponseWriter, status int) {
-	app.InfoLog.Println("Client error with status of", status)
+// ClientError logs and responds with a client error status
+func ClientError(w http.ResponseWriter, r *http.Request, status int) {
+	app.Logger.InfoContext(r.Context(), "client error", "status", status)
 	http.Error(w, http.StatusText(status), status)
 }
 
-func ServerError(w http.ResponseWriter, err error) {
-	trace := fmt.Sprintf("%s\n%s", err.Error(), debug.Stack())
-	app.ErrorLog.Println(trace)
+// ServerError logs the error with its stack trace and responds with an internal server error
+func ServerError(w http.ResponseWriter, r *http.Request, err error) {
+	app.Logger.ErrorContext(r.Context(), err.Error(), "stack", string(debug.Stack()))
 	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 }
+
+// IsAuthenticated returns true if a user is logged in
+func IsAuthenticated(r *http.Request) bool {
+	exists := app.Session.Exists(r.Context(), "user_id")
+	return exists
+}
+
+// GenerateAPIToken returns a new random api token along with the hash to store in its place
+func GenerateAPIToken() (string, string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", "", err
+	}
+	token := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return token, HashAPIToken(token), nil
+}
+
+// HashAPIToken returns the hash an api token is stored and looked up by. The tokens are random
+// and long, so a fast hash is enough to keep them from being usable if the database leaks.
+func HashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// WithAPIToken returns a copy of ctx carrying the api token the request was authenticated with
+func WithAPIToken(ctx context.Context, t models.APIToken) context.Context {
+	return context.WithValue(ctx, apiTokenKey{}, t)
+}
+
+// APIToken returns the api token the request was authenticated with, if any
+func APIToken(r *http.Request) (models.APIToken, bool) {
+	t, ok := r.Context().Value(apiTokenKey{}).(models.APIToken)
+	return t, ok
+}
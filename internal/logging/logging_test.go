@@ -0,0 +1,73 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, slog.LevelInfo)
+
+	ctx := WithRequestID(context.Background(), "abc123")
+	logger.With("component", "test").InfoContext(ctx, "hello", "status", 200)
+
+	var line map[string]interface{}
+	err := json.Unmarshal(buf.Bytes(), &line)
+	if err != nil {
+		t.Fatalf("log line is not json: %s", buf.String())
+	}
+	if line["msg"] != "hello" {
+		t.Errorf("expected msg hello, got %v", line["msg"])
+	}
+	if line["request_id"] != "abc123" {
+		t.Errorf("expected request_id abc123, got %v", line["request_id"])
+	}
+	if line["component"] != "test" {
+		t.Errorf("expected component test, got %v", line["component"])
+	}
+
+	// lines logged without a request id are not tagged
+	buf.Reset()
+	logger.Info("no request")
+	if bytes.Contains(buf.Bytes(), []byte("request_id")) {
+		t.Errorf("expected no request_id, got %s", buf.String())
+	}
+
+	// lines logged during a trace carry its id
+	buf.Reset()
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx = trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID,
+		SpanID:  spanID,
+	}))
+	logger.InfoContext(ctx, "traced")
+	if !bytes.Contains(buf.Bytes(), []byte(`"trace_id":"4bf92f3577b34da6a3ce929d0e0e4736"`)) {
+		t.Errorf("expected trace_id, got %s", buf.String())
+	}
+
+	// lines below the level are dropped
+	buf.Reset()
+	logger.Debug("hidden")
+	if buf.Len() != 0 {
+		t.Errorf("expected debug line to be dropped, got %s", buf.String())
+	}
+}
+
+func TestNewRequestID(t *testing.T) {
+	a := NewRequestID()
+	b := NewRequestID()
+
+	if len(a) != 16 {
+		t.Errorf("expected a 16 characters request id, got %s", a)
+	}
+	if a == b {
+		t.Error("expected request ids to differ")
+	}
+}
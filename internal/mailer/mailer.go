@@ -0,0 +1,156 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/tomdim/bookings/internal/models"
+	"log/slog"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+// sendTimeout is the time a mail is given to be handed over to the SMTP server
+const sendTimeout = 30 * time.Second
+
+// Sender delivers mails, so that they can be sent over SMTP or only logged
+type Sender interface {
+	Send(m models.MailData) error
+}
+
+// SMTP sends mails through an SMTP server, upgrading the connection to tls when the server
+// supports it
+type SMTP struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+}
+
+// Send hands the mail over to the SMTP server
+func (s SMTP) Send(m models.MailData) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(s.Host, strconv.Itoa(s.Port)), sendTimeout)
+	if err != nil {
+		return fmt.Errorf("cannot connect to smtp server: %w", err)
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(sendTimeout))
+	if err != nil {
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		return fmt.Errorf("cannot greet smtp server: %w", err)
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: s.Host})
+		if err != nil {
+			return fmt.Errorf("cannot start tls: %w", err)
+		}
+	}
+	if s.Username != "" {
+		err = c.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host))
+		if err != nil {
+			return fmt.Errorf("cannot authenticate to smtp server: %w", err)
+		}
+	}
+
+	err = c.Mail(m.From)
+	if err != nil {
+		return fmt.Errorf("smtp server refused sender %s: %w", m.From, err)
+	}
+	err = c.Rcpt(m.To)
+	if err != nil {
+		return fmt.Errorf("smtp server refused recipient %s: %w", m.To, err)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(message(m, time.Now()))
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("smtp server refused mail: %w", err)
+	}
+
+	return c.Quit()
+}
+
+// Log logs the mails instead of sending them, for running without an SMTP server
+type Log struct {
+	Logger *slog.Logger
+}
+
+// Send logs the recipient and subject of the mail
+func (l Log) Send(m models.MailData) error {
+	l.Logger.Info("mail not sent, no smtp server configured", "to", m.To, "subject", m.Subject)
+	return nil
+}
+
+// Listen sends the mails received on ch with sender until ctx is done, and then the mails still
+// queued. The returned channel is closed once it has stopped.
+func Listen(ctx context.Context, ch <-chan models.MailData, sender Sender, logger *slog.Logger) <-chan struct{} {
+	done := make(chan struct{})
+
+	send := func(m models.MailData) {
+		err := sender.Send(m)
+		if err != nil {
+			logger.Error("cannot send mail", "to", m.To, "subject", m.Subject, "error", err)
+		}
+	}
+
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case m := <-ch:
+				send(m)
+			case <-ctx.Done():
+				for {
+					select {
+					case m := <-ch:
+						send(m)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return done
+}
+
+// message formats the mail as an html message, encoding the content as quoted-printable so
+// that no line is too long for SMTP
+func message(m models.MailData, date time.Time) []byte {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "From: %s\r\n", (&mail.Address{Address: m.From}).String())
+	fmt.Fprintf(&b, "To: %s\r\n", (&mail.Address{Address: m.To}).String())
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/html; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
+	b.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(&b)
+	qp.Write([]byte(m.Content))
+	qp.Close()
+
+	return b.Bytes()
+}
@@ -0,0 +1,140 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/tomdim/bookings/internal/models"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSMTP is a local SMTP stand-in accepting a single mail, which it sends on the returned channel
+func fakeSMTP(t *testing.T) (int, <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		ln.Close()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		reply := func(s string) { fmt.Fprintf(conn, "%s\r\n", s) }
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "DATA"):
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				received <- data.String()
+				reply("250 queued")
+			case strings.HasPrefix(cmd, "QUIT"):
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+
+	return ln.Addr().(*net.TCPAddr).Port, received
+}
+
+func TestSMTP_Send(t *testing.T) {
+	port, received := fakeSMTP(t)
+
+	s := SMTP{Host: "127.0.0.1", Port: port}
+	err := s.Send(models.MailData{
+		To:      "guest@example.com",
+		From:    "bookings@example.com",
+		Subject: "Reservation confirmation",
+		Content: "<p>See you soon!</p>",
+	})
+	if err != nil {
+		t.Fatalf("cannot send mail: %s", err)
+	}
+
+	msg := <-received
+	for _, expected := range []string{
+		"From: <bookings@example.com>\r\n",
+		"To: <guest@example.com>\r\n",
+		"Subject: Reservation confirmation\r\n",
+		"Content-Type: text/html; charset=UTF-8\r\n",
+		"<p>See you soon!</p>",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Errorf("expected the message to contain %q, got:\n%s", expected, msg)
+		}
+	}
+}
+
+func TestSMTP_Send_Unreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	s := SMTP{Host: "127.0.0.1", Port: port}
+	if err := s.Send(models.MailData{To: "guest@example.com", From: "bookings@example.com"}); err == nil {
+		t.Error("expected an error when the smtp server is unreachable")
+	}
+}
+
+// recorder is a sender keeping the subjects of the mails it is given
+type recorder struct {
+	mu       sync.Mutex
+	subjects []string
+}
+
+func (r *recorder) Send(m models.MailData) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subjects = append(r.subjects, m.Subject)
+	return nil
+}
+
+func TestListen(t *testing.T) {
+	ch := make(chan models.MailData, 10)
+	sender := &recorder{}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := Listen(ctx, ch, sender, logger)
+
+	ch <- models.MailData{Subject: "first"}
+	ch <- models.MailData{Subject: "second"}
+	cancel()
+	<-done
+
+	// the mails queued before stopping are all sent
+	if len(sender.subjects) != 2 {
+		t.Errorf("expected 2 mails sent, got %v", sender.subjects)
+	}
+}
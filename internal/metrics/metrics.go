@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry holds all the metrics exposed by the application
+var Registry = prometheus.NewRegistry()
+
+var (
+	// HTTPRequests counts the requests served, by chi route pattern
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bookings",
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests served, by method, route pattern and status code.",
+	}, []string{"method", "route", "status"})
+
+	// HTTPDuration observes the time spent serving requests, by chi route pattern
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "bookings",
+		Name:      "http_request_duration_seconds",
+		Help:      "Time spent serving HTTP requests, by method and route pattern.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	// ReservationsCreated counts the reservations booked by guests
+	ReservationsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "bookings",
+		Name:      "reservations_created_total",
+		Help:      "Number of reservations created.",
+	})
+
+	// ReservationsCancelled counts the reservations cancelled by guests
+	ReservationsCancelled = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "bookings",
+		Name:      "reservations_cancelled_total",
+		Help:      "Number of reservations cancelled by guests.",
+	})
+
+	// AvailabilitySearches counts the availability searches, by source (form, json or api)
+	AvailabilitySearches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bookings",
+		Name:      "availability_searches_total",
+		Help:      "Number of availability searches, by source.",
+	}, []string{"source"})
+
+	// NoAvailability counts the availability searches that found no room
+	NoAvailability = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "bookings",
+		Name:      "no_availability_total",
+		Help:      "Number of availability searches that found no available room.",
+	})
+
+	// RateLimited counts the requests rejected for being over a rate limit, by limiter (ip, api_ip or api)
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bookings",
+		Name:      "rate_limited_total",
+		Help:      "Number of requests rejected for being over a rate limit, by limiter.",
+	}, []string{"limiter"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPDuration,
+		ReservationsCreated,
+		ReservationsCancelled,
+		AvailabilitySearches,
+		NoAvailability,
+		RateLimited,
+	)
+}
+
+// RegisterDB exposes the connection pool stats of the database
+func RegisterDB(db *sql.DB) error {
+	return Registry.Register(collectors.NewDBStatsCollector(db, "bookings"))
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
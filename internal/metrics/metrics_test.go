@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	_ "github.com/jackc/pgx/v4/stdlib"
+)
+
+func TestHandler(t *testing.T) {
+	ReservationsCreated.Inc()
+	AvailabilitySearches.WithLabelValues("form").Inc()
+	HTTPRequests.WithLabelValues("GET", "/", "200").Inc()
+
+	rr := httptest.NewRecorder()
+	Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("metrics handler returned unexpected response code: got %d, expected %d", rr.Code, http.StatusOK)
+	}
+
+	body := rr.Body.String()
+	for _, name := range []string{
+		"bookings_reservations_created_total 1",
+		`bookings_availability_searches_total{source="form"} 1`,
+		`bookings_http_requests_total{method="GET",route="/",status="200"} 1`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(body, name) {
+			t.Errorf("expected to find %s in metrics output", name)
+		}
+	}
+}
+
+func TestRegisterDB(t *testing.T) {
+	// the pool is never connected, opening it is enough to get its stats
+	db, err := sql.Open("pgx", "host=localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := RegisterDB(db); err != nil {
+		t.Error(err)
+	}
+
+	rr := httptest.NewRecorder()
+	Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rr.Body.String(), `go_sql_open_connections{db_name="bookings"}`) {
+		t.Error("expected to find database pool stats in metrics output")
+	}
+}
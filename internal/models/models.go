@@ -2,6 +2,13 @@ package models
 
 import "time"
 
+// Access levels a user can have, from least to most privileged
+const (
+	AccessLevelStaff   = 1
+	AccessLevelManager = 2
+	AccessLevelOwner   = 3
+)
+
 // User is the user model
 type User struct {
 	ID          int
@@ -9,17 +16,49 @@ type User struct {
 	LastName    string
 	Email       string
 	Password    string
-	AccessLevel string
+	AccessLevel int
 	CreatedAt   time.Time
 	UpdatedAt   time.Time
 }
 
-// Room is the room model
+// Restrictions seeded in the restrictions table
+const (
+	RestrictionReservation = 1
+	RestrictionOwnerBlock  = 2
+)
+
+// Room is the room model. The nightly rate is in cents.
 type Room struct {
-	ID        int
-	RoomName  string
-	CreatedAt time.Time
-	UpdatedAt time.Time
+	ID          int
+	RoomName    string
+	NightlyRate int
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// RatePlan charges a room another nightly rate, in cents, on the nights from StartDate to
+// EndDate, both included. When Weekdays is set, it only applies on those days of the week.
+type RatePlan struct {
+	ID          int
+	RoomID      int
+	Name        string
+	StartDate   time.Time
+	EndDate     time.Time
+	Weekdays    []time.Weekday
+	NightlyRate int
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Room        Room
+}
+
+// HasWeekday returns true if the plan is limited to some days of the week, d being one of them
+func (p RatePlan) HasWeekday(d time.Weekday) bool {
+	for _, w := range p.Weekdays {
+		if w == d {
+			return true
+		}
+	}
+	return false
 }
 
 // Restriction is the restriction model
@@ -43,6 +82,17 @@ type Reservation struct {
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	Room      Room
+	Processed int
+	Reference string
+	Cancelled int
+	// APITokenID is the api token the reservation was made with, 0 for reservations made on the website
+	APITokenID int
+}
+
+// CanCancel returns true if the guest can still cancel the reservation at now, that is at least
+// deadline before the arrival date
+func (r Reservation) CanCancel(now time.Time, deadline time.Duration) bool {
+	return r.Cancelled == 0 && now.Before(r.StartDate.Add(-deadline))
 }
 
 // RoomRestriction is the room restriction model
@@ -59,3 +109,53 @@ type RoomRestriction struct {
 	Reservation   Reservation
 	Restriction   Restriction
 }
+
+// Scopes an api token can be granted
+const (
+	ScopeReadAvailability  = "availability:read"
+	ScopeReadReservations  = "reservations:read"
+	ScopeWriteReservations = "reservations:write"
+)
+
+// Scopes lists every scope an api token can be granted
+var Scopes = []string{ScopeReadAvailability, ScopeReadReservations, ScopeWriteReservations}
+
+// impliedScopes lists the scopes granted along with another one. Tokens booking reservations can
+// read them back, as they could before reading had a scope of its own.
+var impliedScopes = map[string][]string{
+	ScopeWriteReservations: {ScopeReadReservations},
+}
+
+// APIToken is the api token model. Only the hash of the token is stored.
+type APIToken struct {
+	ID        int
+	UserID    int
+	Name      string
+	TokenHash string
+	Scopes    []string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// HasScope returns true if the token was granted the scope, or a scope implying it
+func (t APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+		for _, implied := range impliedScopes[s] {
+			if implied == scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MailData holds an email to send, with its html content already rendered
+type MailData struct {
+	To      string
+	From    string
+	Subject string
+	Content string
+}
@@ -0,0 +1,20 @@
+package openapi
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// Spec is the OpenAPI 3 document describing the JSON endpoints. It has to be updated along with
+// the api routes, which the routes tests check.
+//
+//go:embed openapi.json
+var Spec []byte
+
+// Handler serves the OpenAPI document
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(Spec)
+	})
+}
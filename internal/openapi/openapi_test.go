@@ -0,0 +1,72 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSpec(t *testing.T) {
+	var doc struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	err := json.Unmarshal(Spec, &doc)
+	if err != nil {
+		t.Fatalf("spec is not valid json: %s", err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Errorf("expected an OpenAPI 3 document, got version %q", doc.OpenAPI)
+	}
+	if len(doc.Paths) == 0 {
+		t.Error("expected the spec to describe some paths")
+	}
+
+	// every reference points to a component defined in the document
+	var raw map[string]interface{}
+	_ = json.Unmarshal(Spec, &raw)
+	for _, ref := range refs(raw) {
+		node := interface{}(raw)
+		for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			m, _ := node.(map[string]interface{})
+			node = m[part]
+		}
+		if node == nil {
+			t.Errorf("reference %s is not defined", ref)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	rr := httptest.NewRecorder()
+	Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/api/openapi.json", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("openapi handler returned unexpected response code: got %d, expected %d", rr.Code, http.StatusOK)
+	}
+	if rr.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("expected json content type, got %s", rr.Header().Get("Content-Type"))
+	}
+}
+
+// refs returns the $ref values found anywhere in a decoded json document
+func refs(node interface{}) []string {
+	var out []string
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if s, ok := child.(string); ok && k == "$ref" {
+				out = append(out, s)
+				continue
+			}
+			out = append(out, refs(child)...)
+		}
+	case []interface{}:
+		for _, child := range v {
+			out = append(out, refs(child)...)
+		}
+	}
+	return out
+}
@@ -0,0 +1,188 @@
+package pricing
+
+import (
+	"errors"
+	"fmt"
+	"github.com/tomdim/bookings/internal/models"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNoNights is returned when pricing a stay whose departure is not after its arrival
+var ErrNoNights = errors.New("the departure must be after the arrival")
+
+// ErrInvalidAmount is returned when parsing an amount that is not a positive number of dollars
+var ErrInvalidAmount = errors.New("invalid amount")
+
+// Quote is the price of a stay, broken down into lines of nights charged at the same rate.
+// Amounts are in cents.
+type Quote struct {
+	Nights int
+	Lines  []Line
+	Total  int
+}
+
+// Line is a number of nights charged at the same nightly rate, under the rate plan named Name,
+// or at the room's own rate when Name is empty
+type Line struct {
+	Name     string
+	Nights   int
+	Rate     int
+	Subtotal int
+}
+
+// plan is a rate plan along with the number of nights it covers
+type plan struct {
+	models.RatePlan
+	nights int
+}
+
+// Calculate returns the quote for staying in room from the arrival date to the departure date.
+// Every night is charged at the rate of the most specific rate plan of the room applying to it:
+// plans limited to some days of the week override the ones applying every day, then the plan
+// covering the fewest nights wins, and the latest added one wins ties. Nights no plan applies to
+// are charged at the room's nightly rate, and plans of other rooms are ignored.
+func Calculate(room models.Room, plans []models.RatePlan, start, end time.Time) (Quote, error) {
+	nights := Nights(start, end)
+	if nights < 1 {
+		return Quote{}, ErrNoNights
+	}
+
+	var own []plan
+	for _, p := range plans {
+		if p.RoomID == room.ID {
+			own = append(own, plan{RatePlan: p, nights: planNights(p)})
+		}
+	}
+
+	q := Quote{Nights: nights}
+	lines := make(map[Line]int)
+	night := date(start)
+	for i := 0; i < nights; i++ {
+		line := Line{Rate: room.NightlyRate}
+		if p, ok := mostSpecific(own, night); ok {
+			line = Line{Name: p.Name, Rate: p.NightlyRate}
+		}
+
+		// nights are grouped by plan and rate, in the order they first come up
+		n, ok := lines[line]
+		if !ok {
+			n = len(q.Lines)
+			lines[line] = n
+			q.Lines = append(q.Lines, line)
+		}
+		q.Lines[n].Nights++
+		q.Lines[n].Subtotal += line.Rate
+		q.Total += line.Rate
+
+		night = night.AddDate(0, 0, 1)
+	}
+
+	return q, nil
+}
+
+// ForReservation returns the quote for a reservation, in the room it is for
+func ForReservation(res models.Reservation, plans []models.RatePlan) (Quote, error) {
+	return Calculate(res.Room, plans, res.StartDate, res.EndDate)
+}
+
+// mostSpecific returns the most specific of the plans applying to night
+func mostSpecific(plans []plan, night time.Time) (plan, bool) {
+	var best plan
+	found := false
+	for _, p := range plans {
+		if !applies(p.RatePlan, night) {
+			continue
+		}
+		if !found || moreSpecific(p, best) {
+			best = p
+			found = true
+		}
+	}
+	return best, found
+}
+
+// moreSpecific returns true if plan a overrides plan b
+func moreSpecific(a, b plan) bool {
+	aWeekdays, bWeekdays := len(a.Weekdays) > 0, len(b.Weekdays) > 0
+	if aWeekdays != bWeekdays {
+		return aWeekdays
+	}
+	if a.nights != b.nights {
+		return a.nights < b.nights
+	}
+	return a.ID > b.ID
+}
+
+// applies returns true if the plan charges night
+func applies(p models.RatePlan, night time.Time) bool {
+	if night.Before(date(p.StartDate)) || night.After(date(p.EndDate)) {
+		return false
+	}
+	return len(p.Weekdays) == 0 || p.HasWeekday(night.Weekday())
+}
+
+// planNights returns the number of nights a plan applies to
+func planNights(p models.RatePlan) int {
+	days := Nights(p.StartDate, p.EndDate) + 1
+	if days < 1 || len(p.Weekdays) == 0 {
+		return days
+	}
+
+	// every full week has each of the plan's days once, and the rest are counted one by one
+	weekdays := 0
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if p.HasWeekday(d) {
+			weekdays++
+		}
+	}
+	nights := days / 7 * weekdays
+	first := date(p.StartDate).AddDate(0, 0, days/7*7)
+	for i := 0; i < days%7; i++ {
+		if p.HasWeekday(first.AddDate(0, 0, i).Weekday()) {
+			nights++
+		}
+	}
+	return nights
+}
+
+// Nights returns the number of nights between the arrival and departure dates. Only the dates
+// count, so the time of day and the time zone they were read in make no difference.
+func Nights(start, end time.Time) int {
+	return int(date(end).Sub(date(start)) / (24 * time.Hour))
+}
+
+// date returns the date of t at midnight UTC, where every day lasts 24 hours
+func date(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// Format returns an amount in cents as dollars, such as $1,250.00
+func Format(cents int) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+
+	dollars := strconv.Itoa(cents / 100)
+	for i := len(dollars) - 3; i > 0; i -= 3 {
+		dollars = dollars[:i] + "," + dollars[i:]
+	}
+	return fmt.Sprintf("%s$%s.%02d", sign, dollars, cents%100)
+}
+
+// ParseAmount returns an amount of dollars as typed in a form, such as 180, 180.50 or $1,250,
+// in cents
+func ParseAmount(s string) (int, error) {
+	s = strings.NewReplacer("$", "", ",", "").Replace(strings.TrimSpace(s))
+	dollars, err := strconv.ParseFloat(s, 64)
+	// written so that NaN, which compares false to everything, is rejected too
+	if err != nil || !(dollars > 0 && dollars <= math.MaxInt32/100) {
+		return 0, ErrInvalidAmount
+	}
+	return int(math.Round(dollars * 100)), nil
+}
@@ -0,0 +1,229 @@
+package pricing
+
+import (
+	"errors"
+	"github.com/tomdim/bookings/internal/models"
+	"testing"
+	"time"
+)
+
+func TestCalculate(t *testing.T) {
+	room := models.Room{ID: 1, NightlyRate: 12000}
+	start := time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	q, err := Calculate(room, nil, start, start.AddDate(0, 0, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Nights != 3 || q.Total != 36000 {
+		t.Errorf("expected 3 nights for 36000, got %d nights for %d", q.Nights, q.Total)
+	}
+	if len(q.Lines) != 1 || q.Lines[0].Rate != 12000 || q.Lines[0].Subtotal != 36000 {
+		t.Errorf("expected a single line of 3 nights at 12000, got %+v", q.Lines)
+	}
+
+	for _, end := range []time.Time{start, start.AddDate(0, 0, -1)} {
+		_, err := Calculate(room, nil, start, end)
+		if !errors.Is(err, ErrNoNights) {
+			t.Errorf("expected ErrNoNights for a departure on %s, got %v", end.Format("2006-01-02"), err)
+		}
+	}
+}
+
+// testPlans charge room 1 more on Friday and Saturday nights of 2050, even more in the summer and
+// its weekends, and the most in the first week of August, except for its weekend
+var testPlans = []models.RatePlan{
+	{ID: 1, RoomID: 1, Name: "Summer", NightlyRate: 18000, StartDate: day(2050, 6, 1), EndDate: day(2050, 8, 31)},
+	{ID: 2, RoomID: 1, Name: "Weekends", NightlyRate: 16000, StartDate: day(2050, 1, 1), EndDate: day(2050, 12, 31),
+		Weekdays: []time.Weekday{time.Friday, time.Saturday}},
+	{ID: 3, RoomID: 1, Name: "August week", NightlyRate: 25000, StartDate: day(2050, 8, 1), EndDate: day(2050, 8, 7)},
+	{ID: 4, RoomID: 2, Name: "Other room", NightlyRate: 100, StartDate: day(2050, 1, 1), EndDate: day(2050, 12, 31)},
+	{ID: 5, RoomID: 1, Name: "Summer weekends", NightlyRate: 22000, StartDate: day(2050, 6, 1), EndDate: day(2050, 8, 31),
+		Weekdays: []time.Weekday{time.Friday, time.Saturday}},
+}
+
+var calculatePlansTests = []struct {
+	name     string
+	start    time.Time
+	end      time.Time
+	expected []Line
+	total    int
+}{
+	{
+		"room rate and weekend",
+		day(2050, 1, 5), day(2050, 1, 9), // Wednesday to Sunday
+		[]Line{
+			{Nights: 2, Rate: 12000, Subtotal: 24000},
+			{Name: "Weekends", Nights: 2, Rate: 16000, Subtotal: 32000},
+		},
+		56000,
+	},
+	{
+		// the summer weekends cover fewer nights than the weekends of the whole year
+		"summer weekends win over summer and weekends",
+		day(2050, 6, 2), day(2050, 6, 5), // Thursday to Sunday
+		[]Line{
+			{Name: "Summer", Nights: 1, Rate: 18000, Subtotal: 18000},
+			{Name: "Summer weekends", Nights: 2, Rate: 22000, Subtotal: 44000},
+		},
+		62000,
+	},
+	{
+		"into the august week",
+		day(2050, 7, 30), day(2050, 8, 2), // Saturday to Tuesday
+		[]Line{
+			{Name: "Summer weekends", Nights: 1, Rate: 22000, Subtotal: 22000},
+			{Name: "Summer", Nights: 1, Rate: 18000, Subtotal: 18000},
+			{Name: "August week", Nights: 1, Rate: 25000, Subtotal: 25000},
+		},
+		65000,
+	},
+	{
+		// days of the week override plans applying every day, however short
+		"weekend of the august week",
+		day(2050, 8, 5), day(2050, 8, 8), // Friday to Monday
+		[]Line{
+			{Name: "Summer weekends", Nights: 2, Rate: 22000, Subtotal: 44000},
+			{Name: "August week", Nights: 1, Rate: 25000, Subtotal: 25000},
+		},
+		69000,
+	},
+	{
+		"end date of a plan included",
+		day(2050, 8, 31), day(2050, 9, 2), // Wednesday to Friday
+		[]Line{
+			{Name: "Summer", Nights: 1, Rate: 18000, Subtotal: 18000},
+			{Nights: 1, Rate: 12000, Subtotal: 12000},
+		},
+		30000,
+	},
+}
+
+func TestCalculate_RatePlans(t *testing.T) {
+	room := models.Room{ID: 1, NightlyRate: 12000}
+
+	for _, e := range calculatePlansTests {
+		q, err := Calculate(room, testPlans, e.start, e.end)
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+			continue
+		}
+		if q.Total != e.total {
+			t.Errorf("%s: expected a total of %d, got %d", e.name, e.total, q.Total)
+		}
+		if len(q.Lines) != len(e.expected) {
+			t.Errorf("%s: expected lines %+v, got %+v", e.name, e.expected, q.Lines)
+			continue
+		}
+		for i := range e.expected {
+			if q.Lines[i] != e.expected[i] {
+				t.Errorf("%s: expected lines %+v, got %+v", e.name, e.expected, q.Lines)
+				break
+			}
+		}
+	}
+}
+
+func TestCalculate_Ties(t *testing.T) {
+	room := models.Room{ID: 1, NightlyRate: 12000}
+	plans := []models.RatePlan{
+		{ID: 5, RoomID: 1, Name: "Older", NightlyRate: 13000, StartDate: day(2050, 1, 1), EndDate: day(2050, 1, 31)},
+		{ID: 6, RoomID: 1, Name: "Newer", NightlyRate: 14000, StartDate: day(2050, 1, 1), EndDate: day(2050, 1, 31)},
+	}
+
+	q, err := Calculate(room, plans, day(2050, 1, 10), day(2050, 1, 11))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Lines[0].Name != "Newer" {
+		t.Errorf("expected the latest added plan to win a tie, got %s", q.Lines[0].Name)
+	}
+}
+
+func TestPlanNights(t *testing.T) {
+	// 2050 is not a leap year, and starts on a Saturday, so it has 53 Saturdays and 52 Fridays
+	if n := planNights(testPlans[1]); n != 105 {
+		t.Errorf("expected the weekends of 2050 to cover 105 nights, got %d", n)
+	}
+	if n := planNights(testPlans[0]); n != 92 {
+		t.Errorf("expected the summer to cover 92 nights, got %d", n)
+	}
+}
+
+func day(year int, month time.Month, d int) time.Time {
+	return time.Date(year, month, d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestNights(t *testing.T) {
+	athens, err := time.LoadLocation("Europe/Athens")
+	if err != nil {
+		t.Skip("time zone database not available")
+	}
+
+	var nightsTests = []struct {
+		name     string
+		start    time.Time
+		end      time.Time
+		expected int
+	}{
+		{"one night", time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2050, 1, 2, 0, 0, 0, 0, time.UTC), 1},
+		{"times of day", time.Date(2050, 1, 1, 23, 0, 0, 0, time.UTC), time.Date(2050, 1, 2, 1, 0, 0, 0, time.UTC), 1},
+		{"over a dst change", time.Date(2050, 3, 26, 0, 0, 0, 0, athens), time.Date(2050, 3, 28, 0, 0, 0, 0, athens), 2},
+		{"over a leap day", time.Date(2048, 2, 28, 0, 0, 0, 0, time.UTC), time.Date(2048, 3, 1, 0, 0, 0, 0, time.UTC), 2},
+	}
+
+	for _, e := range nightsTests {
+		if n := Nights(e.start, e.end); n != e.expected {
+			t.Errorf("%s: expected %d nights, got %d", e.name, e.expected, n)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	var formatTests = []struct {
+		cents    int
+		expected string
+	}{
+		{0, "$0.00"},
+		{5, "$0.05"},
+		{12000, "$120.00"},
+		{125050, "$1,250.50"},
+		{123456789, "$1,234,567.89"},
+		{-2500, "-$25.00"},
+	}
+
+	for _, e := range formatTests {
+		if s := Format(e.cents); s != e.expected {
+			t.Errorf("expected %d cents to be formatted as %s, got %s", e.cents, e.expected, s)
+		}
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	var parseAmountTests = []struct {
+		s        string
+		expected int
+		valid    bool
+	}{
+		{"180", 18000, true},
+		{" 180.5 ", 18050, true},
+		{"$1,250.99", 125099, true},
+		{"0.1", 10, true},
+		{"0", 0, false},
+		{"-5", 0, false},
+		{"abc", 0, false},
+		{"", 0, false},
+		{"NaN", 0, false},
+		{"1e100", 0, false},
+	}
+
+	for _, e := range parseAmountTests {
+		cents, err := ParseAmount(e.s)
+		if e.valid && (err != nil || cents != e.expected) {
+			t.Errorf("expected %q to be %d cents, got %d and %v", e.s, e.expected, cents, err)
+		}
+		if !e.valid && !errors.Is(err, ErrInvalidAmount) {
+			t.Errorf("expected %q to be invalid, got %d", e.s, cents)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	now := time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := New(60, 2)
+	l.now = func() time.Time { return now }
+
+	// the burst is let through, then the bucket is empty
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("1.2.3.4"); !ok {
+			t.Fatalf("expected request %d of the burst to be allowed", i+1)
+		}
+	}
+	ok, retryAfter := l.Allow("1.2.3.4")
+	if ok {
+		t.Fatal("expected request over the burst to be rejected")
+	}
+	if retryAfter != time.Second {
+		t.Errorf("expected to retry after 1s at 60 requests a minute, got %s", retryAfter)
+	}
+
+	// other keys have their own bucket
+	if ok, _ := l.Allow("5.6.7.8"); !ok {
+		t.Error("expected another key to be allowed")
+	}
+
+	// a rejected request does not use up a token, so one is available a second later
+	now = now.Add(time.Second)
+	if ok, _ := l.Allow("1.2.3.4"); !ok {
+		t.Error("expected a request to be allowed once a token was added")
+	}
+}
+
+func TestLimiter_Sweep(t *testing.T) {
+	now := time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := New(60, 5)
+	l.now = func() time.Time { return now }
+
+	l.Allow("1.2.3.4")
+	now = now.Add(10 * time.Minute)
+	l.Allow("5.6.7.8")
+
+	if _, ok := l.buckets["1.2.3.4"]; ok {
+		t.Error("expected the idle bucket to be dropped")
+	}
+	if _, ok := l.buckets["5.6.7.8"]; !ok {
+		t.Error("expected the bucket in use to be kept")
+	}
+}
+
+func TestNew_Disabled(t *testing.T) {
+	l := New(0, 10)
+	if l != nil {
+		t.Fatal("expected no limiter when the rate is not positive")
+	}
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.Allow("1.2.3.4"); !ok {
+			t.Fatal("expected a disabled limiter to allow every request")
+		}
+	}
+}
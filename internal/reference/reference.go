@@ -0,0 +1,50 @@
+// Package reference generates the references reservations are known by to guests and partners
+package reference
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+)
+
+// alphabet holds the characters of the references. Letters easily mistaken for digits (I, L, O)
+// and U are left out, as in Crockford's base32.
+const alphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// prefix starts every reference, as in BK-7F3Q-K9XM
+const prefix = "BK"
+
+// length is the number of random characters in a reference, for 40 random bits. The api looks
+// reservations up by reference alone, so the references are long enough not to be found by
+// trying them, whatever the rate limits.
+const length = 8
+
+// typos maps the characters left out of the references to the ones they are mistaken for
+var typos = strings.NewReplacer("O", "0", "I", "1", "L", "1", "-", "", " ", "")
+
+// Generate returns a new random reference such as BK-7F3Q-K9XM. It is the guest's key to their
+// reservation along with their email, so it cannot be guessed from other references.
+func Generate() (string, error) {
+	b := make([]byte, length)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	for i := range b {
+		// the alphabet has 32 characters, so every one is equally likely
+		b[i] = alphabet[b[i]%byte(len(alphabet))]
+	}
+	return fmt.Sprintf("%s-%s-%s", prefix, b[:4], b[4:]), nil
+}
+
+// Normalize returns a reference as typed by a guest in the form it is stored, whatever their
+// case, dashes and spaces, and with the letters mistaken for digits fixed
+func Normalize(reference string) string {
+	ref := typos.Replace(strings.ToUpper(reference))
+	random := strings.TrimPrefix(ref, prefix)
+	if random != ref && len(random) == length {
+		return fmt.Sprintf("%s-%s-%s", prefix, random[:4], random[4:])
+	}
+	// references made before the BK- format are kept as they are
+	return ref
+}
@@ -0,0 +1,46 @@
+package reference
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	valid := regexp.MustCompile(`^BK-[0-9A-HJKMNP-TV-Z]{4}-[0-9A-HJKMNP-TV-Z]{4}$`)
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		ref, err := Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !valid.MatchString(ref) {
+			t.Errorf("unexpected reference format: %s", ref)
+		}
+		seen[ref] = true
+	}
+	if len(seen) != 100 {
+		t.Errorf("expected random references, got %d distinct out of 100", len(seen))
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	var normalizeTests = []struct {
+		reference string
+		expected  string
+	}{
+		{"BK-7F3Q-K9XM", "BK-7F3Q-K9XM"},
+		{"bk7f3qk9xm", "BK-7F3Q-K9XM"},
+		{" bk 7f3q k9 xm ", "BK-7F3Q-K9XM"},
+		{"BK-1OIL-00AB", "BK-1011-00AB"},
+		{"bk-7f3q-k9", "BK7F3QK9"},
+		{"BK-7F3Q-K9X", "BK7F3QK9X"},
+		{"A1B2C3D4E5F6", "A1B2C3D4E5F6"},
+		{"", ""},
+	}
+
+	for _, e := range normalizeTests {
+		if ref := Normalize(e.reference); ref != e.expected {
+			t.Errorf("expected %q to be normalized to %s, got %s", e.reference, e.expected, ref)
+		}
+	}
+}
@@ -7,12 +7,20 @@ import (
 	"github.com/justinas/nosurf"
 	"github.com/tomdim/bookings/internal/config"
 	"github.com/tomdim/bookings/internal/models"
+	"github.com/tomdim/bookings/internal/pricing"
 	"html/template"
 	"net/http"
 	"path/filepath"
+	"time"
 )
 
-var functions = template.FuncMap{}
+var functions = template.FuncMap{
+	"humanDate":  HumanDate,
+	"formatDate": FormatDate,
+	"iterate":    Iterate,
+	"add":        Add,
+	"price":      pricing.Format,
+}
 
 var app *config.AppConfig
 var pathToTemplates = "./templates"
@@ -27,29 +35,49 @@ func AddDefaultData(td *models.TemplateData, r *http.Request) *models.TemplateDa
 	td.Warning = app.Session.PopString(r.Context(), "warning")
 	td.Error = app.Session.PopString(r.Context(), "error")
 	td.CSRFToken = nosurf.Token(r)
+	if app.Session.Exists(r.Context(), "user_id") {
+		td.IsAuthenticated = 1
+		td.AccessLevel = app.Session.GetInt(r.Context(), "access_level")
+	}
 	return td
 }
 
-// Template renders templates using html/template
-func Template(w http.ResponseWriter, r *http.Request, tmpl string, td *models.TemplateData) error {
-	var tc map[string]*template.Template
-	if app.UseCache {
-		// get the template cache from app config
-		tc = app.TemplateCache
-	} else {
-		tc, _ = CreateTemplateCache()
+// HumanDate returns time in YYYY-MM-DD format
+func HumanDate(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+// FormatDate returns time formatted with the given layout
+func FormatDate(t time.Time, f string) string {
+	return t.Format(f)
+}
+
+// Iterate returns a slice of ints, starting at 1, going to count
+func Iterate(count int) []int {
+	var items []int
+	for i := 1; i <= count; i++ {
+		items = append(items, i)
 	}
+	return items
+}
 
-	t, ok := tc[tmpl]
-	if !ok {
-		return errors.New("can't get template from cache")
+// Add returns the sum of two ints
+func Add(a, b int) int {
+	return a + b
+}
+
+// Template renders templates using html/template
+func Template(w http.ResponseWriter, r *http.Request, tmpl string, td *models.TemplateData) error {
+	t, err := lookup(tmpl)
+	if err != nil {
+		return err
 	}
 
 	buf := new(bytes.Buffer)
 
 	td = AddDefaultData(td, r)
 
-	err := t.Execute(buf, td)
+	err = t.Execute(buf, td)
 	if err != nil {
 		return err
 	}
@@ -62,13 +90,51 @@ func Template(w http.ResponseWriter, r *http.Request, tmpl string, td *models.Te
 	return nil
 }
 
+// Mail renders an email template to a string. Emails are not tied to a request, so the template
+// data holds no session messages or csrf token.
+func Mail(tmpl string, td *models.TemplateData) (string, error) {
+	t, err := lookup(tmpl)
+	if err != nil {
+		return "", err
+	}
+
+	buf := new(bytes.Buffer)
+	err = t.Execute(buf, td)
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// lookup returns a template from the cache, or freshly parsed when the cache is not used
+func lookup(tmpl string) (*template.Template, error) {
+	var tc map[string]*template.Template
+	if app.UseCache {
+		// get the template cache from app config
+		tc = app.TemplateCache
+	} else {
+		tc, _ = CreateTemplateCache()
+	}
+
+	t, ok := tc[tmpl]
+	if !ok {
+		return nil, errors.New("can't get template from cache")
+	}
+	return t, nil
+}
+
 func CreateTemplateCache() (map[string]*template.Template, error) {
 	templateCache := map[string]*template.Template{}
 	pages, err := filepath.Glob(fmt.Sprintf("%s/*.page.tmpl", pathToTemplates))
 	if err != nil {
 		return templateCache, err
 	}
-	for _, page := range pages {
+	mails, err := filepath.Glob(fmt.Sprintf("%s/*.mail.tmpl", pathToTemplates))
+	if err != nil {
+		return templateCache, err
+	}
+	for _, page := range append(pages, mails...) {
 		name := filepath.Base(page)
 		ts, err := template.New(name).Funcs(functions).ParseFiles(page)
 		if err != nil {
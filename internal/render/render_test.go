@@ -3,6 +3,7 @@ package render
 import (
 	"github.com/tomdim/bookings/internal/models"
 	"net/http"
+	"strings"
 	"testing"
 )
 
@@ -49,6 +50,34 @@ func TestRenderTemplate(t *testing.T) {
 	}
 }
 
+func TestMail(t *testing.T) {
+	pathToTemplates = "./../../templates"
+
+	tc, err := CreateTemplateCache()
+	if err != nil {
+		t.Error(err)
+	}
+
+	app.TemplateCache = tc
+
+	content, err := Mail("reservation-confirmation.mail.tmpl", &models.TemplateData{
+		Data: map[string]interface{}{
+			"reservation": models.Reservation{FirstName: "John", Room: models.Room{RoomName: "General's Quarters"}},
+		},
+	})
+	if err != nil {
+		t.Errorf("error rendering mail: %s", err)
+	}
+	if !strings.Contains(content, "John") {
+		t.Error("rendered mail does not contain the guest name")
+	}
+
+	_, err = Mail("non-existent.mail.tmpl", &models.TemplateData{})
+	if err == nil {
+		t.Error("rendered mail template does not exist")
+	}
+}
+
 func getSession() (*http.Request, error) {
 	r, err := http.NewRequest("GET", "/test", nil)
 	if err != nil {
@@ -4,8 +4,9 @@ import (
 	"encoding/gob"
 	"github.com/alexedwards/scs/v2"
 	"github.com/tomdim/bookings/internal/config"
+	"github.com/tomdim/bookings/internal/logging"
 	"github.com/tomdim/bookings/internal/models"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"testing"
@@ -24,11 +25,7 @@ func TestMain(m *testing.M) {
 	// Change this to true when in production
 	testApp.InProduction = false
 
-	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
-	testApp.InfoLog = infoLog
-
-	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
-	testApp.ErrorLog = errorLog
+	testApp.Logger = logging.New(os.Stdout, slog.LevelInfo)
 
 	session = scs.New()
 	session.Lifetime = 24 * time.Hour
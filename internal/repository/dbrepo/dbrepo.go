@@ -1,11 +1,23 @@
 package dbrepo
 
 import (
+	"context"
 	"database/sql"
 	"github.com/tomdim/bookings/internal/config"
 	"github.com/tomdim/bookings/internal/repository"
+	"github.com/tomdim/bookings/internal/tracing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// tracer starts the spans of the repository methods. It goes through the global provider, so
+// spans are only exported once tracing has been set up.
+var tracer = otel.Tracer("github.com/tomdim/bookings/internal/repository/dbrepo")
+
 type postgresDBRepo struct {
 	App *config.AppConfig
 	DB  *sql.DB
@@ -16,6 +28,9 @@ type testDBRepo struct {
 	DB  *sql.DB
 }
 
+// defaultQueryTimeout is used when the app config does not set a database query timeout
+const defaultQueryTimeout = 3 * time.Second
+
 func NewPostgresRepo(conn *sql.DB, a *config.AppConfig) repository.DatabaseRepo {
 	return &postgresDBRepo{
 		App: a,
@@ -28,3 +43,33 @@ func NewTestingRepo(a *config.AppConfig) repository.DatabaseRepo {
 		App: a,
 	}
 }
+
+// queryTimeout returns the time a single query is allowed to run
+func (m *postgresDBRepo) queryTimeout() time.Duration {
+	if m.App == nil || m.App.DBQueryTimeout <= 0 {
+		return defaultQueryTimeout
+	}
+	return m.App.DBQueryTimeout
+}
+
+// startSpan starts a span for the repository method named method, which runs the SQL statement
+// named statement
+func startSpan(ctx context.Context, method, statement string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs,
+		attribute.String("db.system", "postgresql"),
+		tracing.Statement.String(statement),
+	)
+	return tracer.Start(ctx, "dbrepo."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// spanError marks the span as failed when err is not nil, and returns err
+func spanError(span trace.Span, err error) error {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
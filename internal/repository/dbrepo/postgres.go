@@ -2,54 +2,190 @@ package dbrepo
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"github.com/tomdim/bookings/internal/models"
+	"github.com/tomdim/bookings/internal/reference"
+	"github.com/tomdim/bookings/internal/repository"
+	"github.com/tomdim/bookings/internal/tracing"
+	"golang.org/x/crypto/bcrypt"
+	"strconv"
+	"strings"
 	"time"
 )
 
-func (m *postgresDBRepo) AllUsers() bool {
+// roomLockNamespace is the first key of the advisory locks taken on rooms, the second being the room id
+const roomLockNamespace = 1
+
+// referenceAttempts is how many random references are tried when inserting a reservation
+const referenceAttempts = 5
+
+func (m *postgresDBRepo) AllUsers(ctx context.Context) bool {
 	return true
 }
 
-// InsertReservation inserts a new reservation to the database
-func (m *postgresDBRepo) InsertReservation(res models.Reservation) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// Ping checks that the database can be reached
+func (m *postgresDBRepo) Ping(ctx context.Context) error {
+	ctx, span := startSpan(ctx, "Ping", "ping")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
 	defer cancel()
 
-	var newID int
-	stmt := `
-		INSERT INTO reservations
-		(first_name, last_name, email, phone, start_date, end_date, room_id, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id
+	return spanError(span, m.DB.PingContext(ctx))
+}
+
+// MigrationVersion returns the version of the latest migration applied to the database
+func (m *postgresDBRepo) MigrationVersion(ctx context.Context) (string, error) {
+	ctx, span := startSpan(ctx, "MigrationVersion", "select_migration_version")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	var version string
+	query := `
+		SELECT 
+			coalesce(max(version), '') 
+		FROM 
+			schema_migration
 	`
-	err := m.DB.QueryRowContext(ctx, stmt,
-		res.FirstName,
-		res.LastName,
-		res.Email,
-		res.Phone,
-		res.StartDate,
-		res.EndDate,
-		res.RoomID,
-		time.Now(),
-		time.Now(),
-	).Scan(&newID)
+	err := m.DB.QueryRowContext(ctx, query).Scan(&version)
 	if err != nil {
-		return 0, err
+		return "", spanError(span, err)
 	}
 
-	return newID, nil
+	return version, nil
 }
 
-// InsertRoomRestriction inserts a new room restriction to the database
-func (m *postgresDBRepo) InsertRoomRestriction(res models.RoomRestriction) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// CreateBookingTx inserts a new reservation along with the room restriction blocking its room,
+// in a single transaction, and returns the new reservation id and reference. Bookings of the same
+// room are serialized, and repository.ErrRoomUnavailable is returned if the dates got taken
+// meanwhile.
+func (m *postgresDBRepo) CreateBookingTx(ctx context.Context, res models.Reservation) (int, string, error) {
+	ctx, span := startSpan(ctx, "CreateBookingTx", "create_booking_tx", tracing.Stay(res.RoomID, res.StartDate, res.EndDate)...)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
 	defer cancel()
 
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, "", spanError(span, err)
+	}
+	// rolling back a committed transaction is a no-op
+	defer tx.Rollback()
+
+	// the lock is held until the transaction ends, so concurrent bookings of the room wait here
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1, $2)`, roomLockNamespace, res.RoomID)
+	if err != nil {
+		return 0, "", spanError(span, err)
+	}
+
+	var numRows int
+	query := `
+		SELECT 
+			count(id) 
+		FROM 
+			room_restrictions
+		WHERE
+		    room_id = $1 and
+			$2 < end_date and $3 > start_date;
+	`
+	err = tx.QueryRowContext(ctx, query, res.RoomID, res.StartDate, res.EndDate).Scan(&numRows)
+	if err != nil {
+		return 0, "", spanError(span, err)
+	}
+	if numRows > 0 {
+		span.AddEvent("room unavailable")
+		return 0, "", repository.ErrRoomUnavailable
+	}
+
+	newID, reference, err := insertReservation(ctx, tx, res)
+	if err != nil {
+		return 0, "", spanError(span, err)
+	}
+
+	err = insertRoomRestriction(ctx, tx, models.RoomRestriction{
+		StartDate:     res.StartDate,
+		EndDate:       res.EndDate,
+		RoomID:        res.RoomID,
+		ReservationID: newID,
+		RestrictionID: models.RestrictionReservation,
+	})
+	if err != nil {
+		return 0, "", spanError(span, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, "", spanError(span, err)
+	}
+	span.SetAttributes(tracing.ReservationID.Int(newID))
+
+	return newID, reference, nil
+}
+
+// insertReservation inserts a new reservation within the booking transaction, under a new random
+// reference. References are short, so one already taken is retried with another rather than
+// failing the booking.
+func insertReservation(ctx context.Context, tx *sql.Tx, res models.Reservation) (int, string, error) {
+	ctx, span := startSpan(ctx, "insertReservation", "insert_reservation", tracing.Stay(res.RoomID, res.StartDate, res.EndDate)...)
+	defer span.End()
+
+	// a conflict does nothing rather than failing, so that the transaction can go on
+	stmt := `
+		INSERT INTO reservations
+		(first_name, last_name, email, phone, start_date, end_date, room_id, reference, api_token_id, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, 0), $10, $11)
+		ON CONFLICT (reference) DO NOTHING
+		returning id
+	`
+	for attempt := 1; attempt <= referenceAttempts; attempt++ {
+		ref, err := reference.Generate()
+		if err != nil {
+			return 0, "", spanError(span, err)
+		}
+
+		var newID int
+		err = tx.QueryRowContext(ctx, stmt,
+			res.FirstName,
+			res.LastName,
+			res.Email,
+			res.Phone,
+			res.StartDate,
+			res.EndDate,
+			res.RoomID,
+			ref,
+			res.APITokenID,
+			time.Now(),
+			time.Now(),
+		).Scan(&newID)
+		if errors.Is(err, sql.ErrNoRows) {
+			span.AddEvent("reference taken")
+			continue
+		}
+		if err != nil {
+			return 0, "", spanError(span, err)
+		}
+
+		return newID, ref, nil
+	}
+
+	return 0, "", spanError(span, errors.New("cannot find a free reservation reference"))
+}
+
+// insertRoomRestriction inserts a new room restriction within the booking transaction
+func insertRoomRestriction(ctx context.Context, tx *sql.Tx, res models.RoomRestriction) error {
+	ctx, span := startSpan(ctx, "insertRoomRestriction", "insert_room_restriction", append(tracing.Stay(res.RoomID, res.StartDate, res.EndDate), tracing.ReservationID.Int(res.ReservationID))...)
+	defer span.End()
+
 	stmt := `
 		INSERT INTO room_restrictions
 		(start_date, end_date, room_id, reservation_id, restriction_id, created_at, updated_at)
 		VALUES ($1, $2, $3, $4, $5, $6, $7)
 	`
-	_, err := m.DB.ExecContext(ctx, stmt,
+	_, err := tx.ExecContext(ctx, stmt,
 		res.StartDate,
 		res.EndDate,
 		res.RoomID,
@@ -59,15 +195,18 @@ func (m *postgresDBRepo) InsertRoomRestriction(res models.RoomRestriction) error
 		time.Now(),
 	)
 	if err != nil {
-		return err
+		return spanError(span, err)
 	}
 
 	return nil
 }
 
 // SearchAvailabilityByDatesByRoomID returns if availability exists for a given room, otherwise false
-func (m *postgresDBRepo) SearchAvailabilityByDatesByRoomID(start, end time.Time, roomID int) (bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) SearchAvailabilityByDatesByRoomID(ctx context.Context, start, end time.Time, roomID int) (bool, error) {
+	ctx, span := startSpan(ctx, "SearchAvailabilityByDatesByRoomID", "count_room_restrictions", tracing.Stay(roomID, start, end)...)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
 	defer cancel()
 
 	var numRows int
@@ -86,21 +225,24 @@ func (m *postgresDBRepo) SearchAvailabilityByDatesByRoomID(start, end time.Time,
 		end,
 	).Scan(&numRows)
 	if err != nil {
-		return false, err
+		return false, spanError(span, err)
 	}
 
 	return numRows == 0, nil
 }
 
 // SearchAvailabilityForAllRooms returns the available rooms by dates
-func (m *postgresDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]models.Room, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) SearchAvailabilityForAllRooms(ctx context.Context, start, end time.Time) ([]models.Room, error) {
+	ctx, span := startSpan(ctx, "SearchAvailabilityForAllRooms", "select_available_rooms", tracing.Dates(start, end)...)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
 	defer cancel()
 
 	var rooms []models.Room
 	query := `
 		SELECT 
-			r.id, r.room_name
+			r.id, r.room_name, r.nightly_rate
 		FROM 
 			rooms r
 		WHERE
@@ -118,7 +260,7 @@ func (m *postgresDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]
 		end,
 	)
 	if err != nil {
-		return rooms, err
+		return rooms, spanError(span, err)
 	}
 
 	for rows.Next() {
@@ -126,9 +268,10 @@ func (m *postgresDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]
 		err := rows.Scan(
 			&room.ID,
 			&room.RoomName,
+			&room.NightlyRate,
 		)
 		if err != nil {
-			return rooms, err
+			return rooms, spanError(span, err)
 		}
 		rooms = append(rooms, room)
 	}
@@ -137,14 +280,17 @@ func (m *postgresDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]
 }
 
 // GetRoomByID returns a room based on its ID
-func (m *postgresDBRepo) GetRoomByID(id int) (models.Room, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) GetRoomByID(ctx context.Context, id int) (models.Room, error) {
+	ctx, span := startSpan(ctx, "GetRoomByID", "select_room_by_id", tracing.RoomID.Int(id))
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
 	defer cancel()
 
 	var room models.Room
 	query := `
 		SELECT 
-			id, room_name, created_at, updated_at
+			id, room_name, nightly_rate, created_at, updated_at
 		FROM 
 			rooms
 		WHERE
@@ -156,12 +302,871 @@ func (m *postgresDBRepo) GetRoomByID(id int) (models.Room, error) {
 	err := row.Scan(
 		&room.ID,
 		&room.RoomName,
+		&room.NightlyRate,
 		&room.CreatedAt,
 		&room.UpdatedAt,
 	)
 	if err != nil {
-		return room, err
+		return room, spanError(span, err)
 	}
 
 	return room, nil
 }
+
+// GetUserByID returns a user by id
+func (m *postgresDBRepo) GetUserByID(ctx context.Context, id int) (models.User, error) {
+	ctx, span := startSpan(ctx, "GetUserByID", "select_user_by_id")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	var u models.User
+	query := `
+		SELECT 
+			id, first_name, last_name, email, password, access_level, created_at, updated_at
+		FROM 
+			users
+		WHERE
+		    id = $1;
+	`
+	row := m.DB.QueryRowContext(ctx, query, id)
+	err := row.Scan(
+		&u.ID,
+		&u.FirstName,
+		&u.LastName,
+		&u.Email,
+		&u.Password,
+		&u.AccessLevel,
+		&u.CreatedAt,
+		&u.UpdatedAt,
+	)
+	if err != nil {
+		return u, spanError(span, err)
+	}
+
+	return u, nil
+}
+
+// UpdateUser updates a user in the database
+func (m *postgresDBRepo) UpdateUser(ctx context.Context, u models.User) error {
+	ctx, span := startSpan(ctx, "UpdateUser", "update_user")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	query := `
+		UPDATE 
+			users 
+		SET 
+			first_name = $1, last_name = $2, email = $3, access_level = $4, updated_at = $5
+		WHERE
+		    id = $6
+	`
+	_, err := m.DB.ExecContext(ctx, query,
+		u.FirstName,
+		u.LastName,
+		u.Email,
+		u.AccessLevel,
+		time.Now(),
+		u.ID,
+	)
+	if err != nil {
+		return spanError(span, err)
+	}
+
+	return nil
+}
+
+// Authenticate authenticates a user by email and password, and returns the user id and hashed password
+func (m *postgresDBRepo) Authenticate(ctx context.Context, email, testPassword string) (int, string, error) {
+	ctx, span := startSpan(ctx, "Authenticate", "select_user_password")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	var id int
+	var hashedPassword string
+
+	query := `
+		SELECT 
+			id, password 
+		FROM 
+			users 
+		WHERE 
+			email = $1
+	`
+	row := m.DB.QueryRowContext(ctx, query, email)
+	err := row.Scan(&id, &hashedPassword)
+	if err != nil {
+		return id, "", spanError(span, err)
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(testPassword))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return 0, "", errors.New("incorrect password")
+	} else if err != nil {
+		return 0, "", spanError(span, err)
+	}
+
+	return id, hashedPassword, nil
+}
+
+// AllReservations returns a slice of all reservations
+func (m *postgresDBRepo) AllReservations(ctx context.Context) ([]models.Reservation, error) {
+	ctx, span := startSpan(ctx, "AllReservations", "select_all_reservations")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	query := `
+		SELECT 
+			r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, 
+			r.end_date, r.room_id, r.created_at, r.updated_at, r.processed, r.reference, r.cancelled,
+			COALESCE(r.api_token_id, 0), rm.id, rm.room_name
+		FROM 
+			reservations r
+		LEFT JOIN rooms rm ON (r.room_id = rm.id)
+		ORDER BY 
+			r.start_date ASC
+	`
+	reservations, err := m.queryReservations(ctx, query)
+	return reservations, spanError(span, err)
+}
+
+// NewReservations returns a slice of the reservations not yet processed
+func (m *postgresDBRepo) NewReservations(ctx context.Context) ([]models.Reservation, error) {
+	ctx, span := startSpan(ctx, "NewReservations", "select_new_reservations")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	query := `
+		SELECT 
+			r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, 
+			r.end_date, r.room_id, r.created_at, r.updated_at, r.processed, r.reference, r.cancelled,
+			rm.id, rm.room_name
+		FROM 
+			reservations r
+		LEFT JOIN rooms rm ON (r.room_id = rm.id)
+		WHERE
+			r.processed = 0 and r.cancelled = 0
+		ORDER BY 
+			r.start_date ASC
+	`
+	reservations, err := m.queryReservations(ctx, query)
+	return reservations, spanError(span, err)
+}
+
+// GetReservationByID returns a reservation, along with its room, by id
+func (m *postgresDBRepo) GetReservationByID(ctx context.Context, id int) (models.Reservation, error) {
+	ctx, span := startSpan(ctx, "GetReservationByID", "select_reservation_by_id", tracing.ReservationID.Int(id))
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	res, err := m.getReservation(ctx, "r.id = $1", id)
+	return res, spanError(span, err)
+}
+
+// GetReservationByReference returns a reservation, along with its room, by reference
+func (m *postgresDBRepo) GetReservationByReference(ctx context.Context, reference string) (models.Reservation, error) {
+	ctx, span := startSpan(ctx, "GetReservationByReference", "select_reservation_by_reference")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	res, err := m.getReservation(ctx, "r.reference = $1", reference)
+	if err == nil {
+		span.SetAttributes(tracing.ReservationID.Int(res.ID))
+	}
+	return res, spanError(span, err)
+}
+
+// UpdateReservation updates the guest details of a reservation
+func (m *postgresDBRepo) UpdateReservation(ctx context.Context, res models.Reservation) error {
+	ctx, span := startSpan(ctx, "UpdateReservation", "update_reservation", tracing.ReservationID.Int(res.ID))
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	query := `
+		UPDATE 
+			reservations 
+		SET 
+			first_name = $1, last_name = $2, email = $3, phone = $4, updated_at = $5
+		WHERE
+		    id = $6
+	`
+	_, err := m.DB.ExecContext(ctx, query,
+		res.FirstName,
+		res.LastName,
+		res.Email,
+		res.Phone,
+		time.Now(),
+		res.ID,
+	)
+	if err != nil {
+		return spanError(span, err)
+	}
+
+	return nil
+}
+
+// DeleteReservation deletes a reservation along with its room restriction
+func (m *postgresDBRepo) DeleteReservation(ctx context.Context, id int) error {
+	ctx, span := startSpan(ctx, "DeleteReservation", "delete_reservation", tracing.ReservationID.Int(id))
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return spanError(span, err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM room_restrictions WHERE reservation_id = $1`, id)
+	if err != nil {
+		return spanError(span, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM reservations WHERE id = $1`, id)
+	if err != nil {
+		return spanError(span, err)
+	}
+
+	return spanError(span, tx.Commit())
+}
+
+// CancelReservation marks a reservation as cancelled and deletes the room restriction blocking
+// its room, so that the room can be booked again for its dates
+func (m *postgresDBRepo) CancelReservation(ctx context.Context, id int) error {
+	ctx, span := startSpan(ctx, "CancelReservation", "cancel_reservation", tracing.ReservationID.Int(id))
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return spanError(span, err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM room_restrictions WHERE reservation_id = $1`, id)
+	if err != nil {
+		return spanError(span, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE reservations SET cancelled = 1, updated_at = $1 WHERE id = $2`, time.Now(), id)
+	if err != nil {
+		return spanError(span, err)
+	}
+
+	return spanError(span, tx.Commit())
+}
+
+// UpdateProcessedForReservation sets the processed flag of a reservation
+func (m *postgresDBRepo) UpdateProcessedForReservation(ctx context.Context, id, processed int) error {
+	ctx, span := startSpan(ctx, "UpdateProcessedForReservation", "update_reservation_processed", tracing.ReservationID.Int(id))
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	query := `
+		UPDATE 
+			reservations 
+		SET 
+			processed = $1, updated_at = $2
+		WHERE
+		    id = $3
+	`
+	_, err := m.DB.ExecContext(ctx, query, processed, time.Now(), id)
+	if err != nil {
+		return spanError(span, err)
+	}
+
+	return nil
+}
+
+// AllRooms returns all rooms
+func (m *postgresDBRepo) AllRooms(ctx context.Context) ([]models.Room, error) {
+	ctx, span := startSpan(ctx, "AllRooms", "select_all_rooms")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	var rooms []models.Room
+	query := `
+		SELECT 
+			id, room_name, nightly_rate, created_at, updated_at 
+		FROM 
+			rooms 
+		ORDER BY 
+			room_name
+	`
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return rooms, spanError(span, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rm models.Room
+		err := rows.Scan(
+			&rm.ID,
+			&rm.RoomName,
+			&rm.NightlyRate,
+			&rm.CreatedAt,
+			&rm.UpdatedAt,
+		)
+		if err != nil {
+			return rooms, spanError(span, err)
+		}
+		rooms = append(rooms, rm)
+	}
+
+	if err = rows.Err(); err != nil {
+		return rooms, spanError(span, err)
+	}
+
+	return rooms, nil
+}
+
+// GetRestrictionsForRoomByDate returns the restrictions of a room overlapping a date range
+func (m *postgresDBRepo) GetRestrictionsForRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
+	ctx, span := startSpan(ctx, "GetRestrictionsForRoomByDate", "select_room_restrictions", tracing.Stay(roomID, start, end)...)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	var restrictions []models.RoomRestriction
+	query := `
+		SELECT 
+			id, coalesce(reservation_id, 0), restriction_id, room_id, start_date, end_date
+		FROM 
+			room_restrictions 
+		WHERE 
+			$1 < end_date and $2 >= start_date and room_id = $3
+	`
+	rows, err := m.DB.QueryContext(ctx, query, start, end, roomID)
+	if err != nil {
+		return restrictions, spanError(span, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r models.RoomRestriction
+		err := rows.Scan(
+			&r.ID,
+			&r.ReservationID,
+			&r.RestrictionID,
+			&r.RoomID,
+			&r.StartDate,
+			&r.EndDate,
+		)
+		if err != nil {
+			return restrictions, spanError(span, err)
+		}
+		restrictions = append(restrictions, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return restrictions, spanError(span, err)
+	}
+
+	return restrictions, nil
+}
+
+// InsertBlockForRoom inserts an owner block for a room on a single day. Like bookings, blocks
+// are serialized with the other bookings of the room, and repository.ErrRoomUnavailable is
+// returned if the day is already booked or blocked.
+func (m *postgresDBRepo) InsertBlockForRoom(ctx context.Context, id int, startDate time.Time) error {
+	ctx, span := startSpan(ctx, "InsertBlockForRoom", "insert_owner_block", tracing.RoomID.Int(id))
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return spanError(span, err)
+	}
+	// rolling back a committed transaction is a no-op
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1, $2)`, roomLockNamespace, id)
+	if err != nil {
+		return spanError(span, err)
+	}
+
+	endDate := startDate.AddDate(0, 0, 1)
+
+	var numRows int
+	query := `
+		SELECT 
+			count(id) 
+		FROM 
+			room_restrictions
+		WHERE
+		    room_id = $1 and
+			$2 < end_date and $3 > start_date;
+	`
+	err = tx.QueryRowContext(ctx, query, id, startDate, endDate).Scan(&numRows)
+	if err != nil {
+		return spanError(span, err)
+	}
+	if numRows > 0 {
+		span.AddEvent("room unavailable")
+		return repository.ErrRoomUnavailable
+	}
+
+	stmt := `
+		INSERT INTO room_restrictions
+		(start_date, end_date, room_id, restriction_id, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	_, err = tx.ExecContext(ctx, stmt,
+		startDate,
+		endDate,
+		id,
+		models.RestrictionOwnerBlock,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return spanError(span, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return spanError(span, err)
+	}
+
+	return nil
+}
+
+// DeleteBlockByID deletes an owner block
+func (m *postgresDBRepo) DeleteBlockByID(ctx context.Context, id int) error {
+	ctx, span := startSpan(ctx, "DeleteBlockByID", "delete_owner_block")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	query := `
+		DELETE FROM 
+			room_restrictions 
+		WHERE 
+			id = $1 and restriction_id = $2
+	`
+	_, err := m.DB.ExecContext(ctx, query, id, models.RestrictionOwnerBlock)
+	if err != nil {
+		return spanError(span, err)
+	}
+
+	return nil
+}
+
+// InsertAPIToken inserts a new api token and returns its id
+func (m *postgresDBRepo) InsertAPIToken(ctx context.Context, t models.APIToken) (int, error) {
+	ctx, span := startSpan(ctx, "InsertAPIToken", "insert_api_token")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	var newID int
+	stmt := `
+		INSERT INTO api_tokens
+		(user_id, name, token_hash, scopes, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6) returning id
+	`
+	err := m.DB.QueryRowContext(ctx, stmt,
+		t.UserID,
+		t.Name,
+		t.TokenHash,
+		strings.Join(t.Scopes, ","),
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, spanError(span, err)
+	}
+
+	return newID, nil
+}
+
+// GetAPITokenByHash returns the api token having the given hash
+func (m *postgresDBRepo) GetAPITokenByHash(ctx context.Context, hash string) (models.APIToken, error) {
+	ctx, span := startSpan(ctx, "GetAPITokenByHash", "select_api_token_by_hash")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	var t models.APIToken
+	var scopes string
+	query := `
+		SELECT 
+			id, user_id, name, token_hash, scopes, created_at, updated_at
+		FROM 
+			api_tokens
+		WHERE
+			token_hash = $1
+	`
+	err := m.DB.QueryRowContext(ctx, query, hash).Scan(
+		&t.ID,
+		&t.UserID,
+		&t.Name,
+		&t.TokenHash,
+		&scopes,
+		&t.CreatedAt,
+		&t.UpdatedAt,
+	)
+	if err != nil {
+		return t, spanError(span, err)
+	}
+	t.Scopes = splitScopes(scopes)
+
+	return t, nil
+}
+
+// AllAPITokens returns all api tokens
+func (m *postgresDBRepo) AllAPITokens(ctx context.Context) ([]models.APIToken, error) {
+	ctx, span := startSpan(ctx, "AllAPITokens", "select_all_api_tokens")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	var tokens []models.APIToken
+	query := `
+		SELECT 
+			id, user_id, name, token_hash, scopes, created_at, updated_at
+		FROM 
+			api_tokens
+		ORDER BY 
+			name
+	`
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return tokens, spanError(span, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t models.APIToken
+		var scopes string
+		err := rows.Scan(
+			&t.ID,
+			&t.UserID,
+			&t.Name,
+			&t.TokenHash,
+			&scopes,
+			&t.CreatedAt,
+			&t.UpdatedAt,
+		)
+		if err != nil {
+			return tokens, spanError(span, err)
+		}
+		t.Scopes = splitScopes(scopes)
+		tokens = append(tokens, t)
+	}
+
+	if err = rows.Err(); err != nil {
+		return tokens, spanError(span, err)
+	}
+
+	return tokens, nil
+}
+
+// DeleteAPIToken deletes an api token, revoking it
+func (m *postgresDBRepo) DeleteAPIToken(ctx context.Context, id int) error {
+	ctx, span := startSpan(ctx, "DeleteAPIToken", "delete_api_token")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM api_tokens WHERE id = $1`, id)
+	if err != nil {
+		return spanError(span, err)
+	}
+
+	return nil
+}
+
+// splitScopes splits the comma separated scopes stored with an api token
+func splitScopes(scopes string) []string {
+	if scopes == "" {
+		return nil
+	}
+	return strings.Split(scopes, ",")
+}
+
+// InsertRatePlan inserts a new rate plan and returns its id
+func (m *postgresDBRepo) InsertRatePlan(ctx context.Context, p models.RatePlan) (int, error) {
+	ctx, span := startSpan(ctx, "InsertRatePlan", "insert_rate_plan", tracing.Stay(p.RoomID, p.StartDate, p.EndDate)...)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	var newID int
+	stmt := `
+		INSERT INTO rate_plans
+		(room_id, name, start_date, end_date, weekdays, nightly_rate, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) returning id
+	`
+	err := m.DB.QueryRowContext(ctx, stmt,
+		p.RoomID,
+		p.Name,
+		p.StartDate,
+		p.EndDate,
+		joinWeekdays(p.Weekdays),
+		p.NightlyRate,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, spanError(span, err)
+	}
+
+	return newID, nil
+}
+
+// AllRatePlans returns all rate plans, along with their room
+func (m *postgresDBRepo) AllRatePlans(ctx context.Context) ([]models.RatePlan, error) {
+	ctx, span := startSpan(ctx, "AllRatePlans", "select_all_rate_plans")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	query := `
+		SELECT 
+			p.id, p.room_id, p.name, p.start_date, p.end_date, p.weekdays, p.nightly_rate,
+			p.created_at, p.updated_at, rm.id, rm.room_name, rm.nightly_rate
+		FROM 
+			rate_plans p
+			LEFT JOIN rooms rm ON (p.room_id = rm.id)
+		ORDER BY 
+			rm.room_name, p.start_date, p.id
+	`
+	plans, err := m.queryRatePlans(ctx, query)
+	if err != nil {
+		return plans, spanError(span, err)
+	}
+
+	return plans, nil
+}
+
+// GetRatePlansByDates returns the rate plans of every room applying to some night between the
+// arrival and departure dates
+func (m *postgresDBRepo) GetRatePlansByDates(ctx context.Context, start, end time.Time) ([]models.RatePlan, error) {
+	ctx, span := startSpan(ctx, "GetRatePlansByDates", "select_rate_plans_by_dates", tracing.Dates(start, end)...)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	// the departure day is not a night of the stay, while the end date of a plan is
+	query := `
+		SELECT 
+			p.id, p.room_id, p.name, p.start_date, p.end_date, p.weekdays, p.nightly_rate,
+			p.created_at, p.updated_at, rm.id, rm.room_name, rm.nightly_rate
+		FROM 
+			rate_plans p
+			LEFT JOIN rooms rm ON (p.room_id = rm.id)
+		WHERE
+			p.start_date < $2 and p.end_date >= $1
+		ORDER BY 
+			p.id
+	`
+	plans, err := m.queryRatePlans(ctx, query, start, end)
+	if err != nil {
+		return plans, spanError(span, err)
+	}
+
+	return plans, nil
+}
+
+// DeleteRatePlan deletes a rate plan
+func (m *postgresDBRepo) DeleteRatePlan(ctx context.Context, id int) error {
+	ctx, span := startSpan(ctx, "DeleteRatePlan", "delete_rate_plan")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout())
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM rate_plans WHERE id = $1`, id)
+	if err != nil {
+		return spanError(span, err)
+	}
+
+	return nil
+}
+
+// queryRatePlans runs a query selecting rate plans joined with their room
+func (m *postgresDBRepo) queryRatePlans(ctx context.Context, query string, args ...interface{}) ([]models.RatePlan, error) {
+	var plans []models.RatePlan
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return plans, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p models.RatePlan
+		var weekdays string
+		err := rows.Scan(
+			&p.ID,
+			&p.RoomID,
+			&p.Name,
+			&p.StartDate,
+			&p.EndDate,
+			&weekdays,
+			&p.NightlyRate,
+			&p.CreatedAt,
+			&p.UpdatedAt,
+			&p.Room.ID,
+			&p.Room.RoomName,
+			&p.Room.NightlyRate,
+		)
+		if err != nil {
+			return plans, err
+		}
+		p.Weekdays, err = splitWeekdays(weekdays)
+		if err != nil {
+			return plans, err
+		}
+		plans = append(plans, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return plans, err
+	}
+
+	return plans, nil
+}
+
+// joinWeekdays returns the days of the week a rate plan is limited to as stored, such as "5,6"
+// for Fridays and Saturdays
+func joinWeekdays(weekdays []time.Weekday) string {
+	days := make([]string, 0, len(weekdays))
+	for _, d := range weekdays {
+		days = append(days, strconv.Itoa(int(d)))
+	}
+	return strings.Join(days, ",")
+}
+
+// splitWeekdays splits the comma separated days of the week stored with a rate plan
+func splitWeekdays(weekdays string) ([]time.Weekday, error) {
+	if weekdays == "" {
+		return nil, nil
+	}
+
+	var days []time.Weekday
+	for _, s := range strings.Split(weekdays, ",") {
+		d, err := strconv.Atoi(s)
+		if err != nil || d < int(time.Sunday) || d > int(time.Saturday) {
+			return nil, fmt.Errorf("invalid rate plan weekday %q", s)
+		}
+		days = append(days, time.Weekday(d))
+	}
+	return days, nil
+}
+
+// queryReservations runs a query selecting reservations joined with their room
+func (m *postgresDBRepo) queryReservations(ctx context.Context, query string, args ...interface{}) ([]models.Reservation, error) {
+	var reservations []models.Reservation
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return reservations, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i models.Reservation
+		err := rows.Scan(
+			&i.ID,
+			&i.FirstName,
+			&i.LastName,
+			&i.Email,
+			&i.Phone,
+			&i.StartDate,
+			&i.EndDate,
+			&i.RoomID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Processed,
+			&i.Reference,
+			&i.Cancelled,
+			&i.Room.ID,
+			&i.Room.RoomName,
+		)
+		if err != nil {
+			return reservations, err
+		}
+		reservations = append(reservations, i)
+	}
+
+	if err = rows.Err(); err != nil {
+		return reservations, err
+	}
+
+	return reservations, nil
+}
+
+// getReservation returns the reservation, along with its room, matching the where clause
+func (m *postgresDBRepo) getReservation(ctx context.Context, where string, args ...interface{}) (models.Reservation, error) {
+	var res models.Reservation
+	query := `
+		SELECT 
+			r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, 
+			r.end_date, r.room_id, r.created_at, r.updated_at, r.processed, r.reference, r.cancelled,
+			rm.id, rm.room_name
+		FROM 
+			reservations r
+		LEFT JOIN rooms rm ON (r.room_id = rm.id)
+		WHERE
+			` + where
+	row := m.DB.QueryRowContext(ctx, query, args...)
+	err := row.Scan(
+		&res.ID,
+		&res.FirstName,
+		&res.LastName,
+		&res.Email,
+		&res.Phone,
+		&res.StartDate,
+		&res.EndDate,
+		&res.RoomID,
+		&res.CreatedAt,
+		&res.UpdatedAt,
+		&res.Processed,
+		&res.Reference,
+		&res.Cancelled,
+		&res.APITokenID,
+		&res.Room.ID,
+		&res.Room.RoomName,
+	)
+	if err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
@@ -1,36 +1,50 @@
 package dbrepo
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"github.com/tomdim/bookings/internal/models"
+	"github.com/tomdim/bookings/internal/repository"
 	"time"
 )
 
-func (m *testDBRepo) AllUsers() bool {
+func (m *testDBRepo) AllUsers(ctx context.Context) bool {
 	return true
 }
 
-// InsertReservation inserts a new reservation to the database
-func (m *testDBRepo) InsertReservation(res models.Reservation) (int, error) {
-	// if the room id is 2, then fail, otherwise pass
-	if res.RoomID == 2 {
-		return 0, errors.New("test error")
-	}
+// Ping checks that the database can be reached
+func (m *testDBRepo) Ping(ctx context.Context) error {
+	return nil
+}
 
-	return 1, nil
+// MigrationVersion returns the version of the latest migration applied to the database
+func (m *testDBRepo) MigrationVersion(ctx context.Context) (string, error) {
+	return "20261018100000", nil
 }
 
-// InsertRoomRestriction inserts a new room restriction to the database
-func (m *testDBRepo) InsertRoomRestriction(res models.RoomRestriction) error {
-	// if the room id is 1000, then fail, otherwise pass
+// CreateBookingTx inserts a new reservation along with the room restriction blocking its room
+func (m *testDBRepo) CreateBookingTx(ctx context.Context, res models.Reservation) (int, string, error) {
+	// if the room id is 3 or 4, then it was just taken
+	if res.RoomID == 3 || res.RoomID == 4 {
+		return 0, "", repository.ErrRoomUnavailable
+	}
+
+	// if the room id is 2, then inserting the reservation fails
+	if res.RoomID == 2 {
+		return 0, "", errors.New("test error")
+	}
+	// if the room id is 1000, then inserting the room restriction fails
 	if res.RoomID == 1000 {
-		return errors.New("test error")
+		return 0, "", errors.New("test error")
 	}
-	return nil
+
+	// the reference of the cancellable test reservation, so that it can be looked up
+	return 1, "BK-TEST-0001", nil
 }
 
 // SearchAvailabilityByDatesByRoomID returns if availability exists for a given room, otherwise false
-func (m *testDBRepo) SearchAvailabilityByDatesByRoomID(start, end time.Time, roomID int) (bool, error) {
+func (m *testDBRepo) SearchAvailabilityByDatesByRoomID(ctx context.Context, start, end time.Time, roomID int) (bool, error) {
 	// if the room id is 1000, then return error
 	if roomID == 1000 {
 		return false, errors.New("test error")
@@ -44,16 +58,17 @@ func (m *testDBRepo) SearchAvailabilityByDatesByRoomID(start, end time.Time, roo
 }
 
 // SearchAvailabilityForAllRooms returns the available rooms by dates
-func (m *testDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]models.Room, error) {
+func (m *testDBRepo) SearchAvailabilityForAllRooms(ctx context.Context, start, end time.Time) ([]models.Room, error) {
 	var rooms []models.Room
 
 	startDate := start.Format("2006-01-02")
 	if startDate == "2050-01-01" {
 		room := models.Room{
-			ID:        1,
-			RoomName:  "test room",
-			CreatedAt: time.Now(),
-			UpdatedAt: time.Now(),
+			ID:          1,
+			RoomName:    "test room",
+			NightlyRate: 10000,
+			CreatedAt:   time.Now(),
+			UpdatedAt:   time.Now(),
 		}
 		rooms = append(rooms, room)
 	} else if startDate == "2000-01-01" {
@@ -64,17 +79,351 @@ func (m *testDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]mode
 }
 
 // GetRoomByID returns a room based on its ID
-func (m *testDBRepo) GetRoomByID(id int) (models.Room, error) {
+func (m *testDBRepo) GetRoomByID(ctx context.Context, id int) (models.Room, error) {
 	var room models.Room
+	// if the room id is 99, then it does not exist
+	if id == 99 {
+		return room, sql.ErrNoRows
+	}
 	if id == 2 {
 		return models.Room{
-			ID:        2,
-			RoomName:  "General's Quarters",
-			CreatedAt: time.Now(),
-			UpdatedAt: time.Now(),
+			ID:          2,
+			RoomName:    "General's Quarters",
+			NightlyRate: 12000,
+			CreatedAt:   time.Now(),
+			UpdatedAt:   time.Now(),
+		}, nil
+	} else if id == 4 {
+		return models.Room{
+			ID:          4,
+			RoomName:    "Major's Suite",
+			NightlyRate: 15000,
+			CreatedAt:   time.Now(),
+			UpdatedAt:   time.Now(),
 		}, nil
 	} else if id >= 3 {
 		return room, errors.New("test error")
 	}
 	return room, nil
 }
+
+// GetUserByID returns a user by id
+func (m *testDBRepo) GetUserByID(ctx context.Context, id int) (models.User, error) {
+	var u models.User
+	// if the user id is 1, then return the test owner
+	if id == 1 {
+		u = models.User{
+			ID:          1,
+			FirstName:   "Test",
+			LastName:    "Owner",
+			Email:       "me@here.ca",
+			AccessLevel: models.AccessLevelOwner,
+		}
+	}
+	// if the user id is 2, then return a staff member
+	if id == 2 {
+		u = models.User{
+			ID:          2,
+			FirstName:   "Test",
+			LastName:    "Staff",
+			Email:       "staff@here.ca",
+			AccessLevel: models.AccessLevelStaff,
+		}
+	}
+	return u, nil
+}
+
+// UpdateUser updates a user in the database
+func (m *testDBRepo) UpdateUser(ctx context.Context, u models.User) error {
+	return nil
+}
+
+// Authenticate authenticates a user by email and password
+func (m *testDBRepo) Authenticate(ctx context.Context, email, testPassword string) (int, string, error) {
+	// only the test user with the test password can log in
+	if email == "me@here.ca" && testPassword == "password" {
+		return 1, "", nil
+	}
+	return 0, "", errors.New("invalid credentials")
+}
+
+// AllReservations returns a slice of all reservations
+func (m *testDBRepo) AllReservations(ctx context.Context) ([]models.Reservation, error) {
+	var reservations []models.Reservation
+	return reservations, nil
+}
+
+// NewReservations returns a slice of the reservations not yet processed
+func (m *testDBRepo) NewReservations(ctx context.Context) ([]models.Reservation, error) {
+	var reservations []models.Reservation
+	return reservations, nil
+}
+
+// GetReservationByID returns a reservation, along with its room, by id
+func (m *testDBRepo) GetReservationByID(ctx context.Context, id int) (models.Reservation, error) {
+	var res models.Reservation
+	// if the reservation id is 99, then it does not exist
+	if id == 99 {
+		return res, sql.ErrNoRows
+	}
+	// if the reservation id is 3 or more, then fail
+	if id >= 3 {
+		return res, errors.New("test error")
+	}
+
+	res = models.Reservation{
+		ID:        id,
+		FirstName: "John",
+		LastName:  "Smith",
+		Email:     "john@smith.com",
+		Phone:     "123456789",
+		RoomID:    1,
+		Room: models.Room{
+			ID:       1,
+			RoomName: "General's Quarters",
+		},
+	}
+	return res, nil
+}
+
+// UpdateReservation updates the guest details of a reservation
+func (m *testDBRepo) UpdateReservation(ctx context.Context, res models.Reservation) error {
+	// if the reservation id is 2, then fail
+	if res.ID == 2 {
+		return errors.New("test error")
+	}
+	return nil
+}
+
+// GetReservationByReference returns a reservation, along with its room, by reference
+func (m *testDBRepo) GetReservationByReference(ctx context.Context, reference string) (models.Reservation, error) {
+	res := models.Reservation{
+		FirstName: "John",
+		LastName:  "Smith",
+		Email:     "john@smith.com",
+		Phone:     "123456789",
+		StartDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:   time.Date(2050, 1, 2, 0, 0, 0, 0, time.UTC),
+		RoomID:    1,
+		Room: models.Room{
+			ID:       1,
+			RoomName: "General's Quarters",
+		},
+		Reference: reference,
+	}
+
+	switch reference {
+	case "BK-TEST-0001":
+		// can be cancelled, made with the reservations api token
+		res.ID = 1
+		res.APITokenID = 2
+	case "BK-TEST-0002":
+		// arrives tomorrow, past the cancel deadline
+		res.ID = 2
+		res.StartDate = time.Now().Add(24 * time.Hour)
+		res.EndDate = res.StartDate.Add(24 * time.Hour)
+	case "BK-TEST-0003":
+		// can be cancelled, but cancelling fails
+		res.ID = 3
+	case "BK-TEST-0004":
+		// already cancelled
+		res.ID = 4
+		res.Cancelled = 1
+	case "BK-TEST-ERR1":
+		return models.Reservation{}, errors.New("test error")
+	default:
+		return models.Reservation{}, sql.ErrNoRows
+	}
+	return res, nil
+}
+
+// DeleteReservation deletes a reservation along with its room restriction
+func (m *testDBRepo) DeleteReservation(ctx context.Context, id int) error {
+	// if the reservation id is 2, then fail
+	if id == 2 {
+		return errors.New("test error")
+	}
+	return nil
+}
+
+// CancelReservation marks a reservation as cancelled and deletes its room restriction
+func (m *testDBRepo) CancelReservation(ctx context.Context, id int) error {
+	// if the reservation id is 3, then fail
+	if id == 3 {
+		return errors.New("test error")
+	}
+	return nil
+}
+
+// UpdateProcessedForReservation sets the processed flag of a reservation
+func (m *testDBRepo) UpdateProcessedForReservation(ctx context.Context, id, processed int) error {
+	// if the reservation id is 2, then fail
+	if id == 2 {
+		return errors.New("test error")
+	}
+	return nil
+}
+
+// AllRooms returns all rooms
+func (m *testDBRepo) AllRooms(ctx context.Context) ([]models.Room, error) {
+	var rooms []models.Room
+	rooms = append(rooms, models.Room{
+		ID:          1,
+		RoomName:    "General's Quarters",
+		NightlyRate: 12000,
+	})
+	return rooms, nil
+}
+
+// GetRestrictionsForRoomByDate returns the restrictions of a room overlapping a date range
+func (m *testDBRepo) GetRestrictionsForRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
+	var restrictions []models.RoomRestriction
+
+	// a reservation on the first two days of the month, and an owner block on the fourth
+	restrictions = append(restrictions, models.RoomRestriction{
+		ID:            1,
+		StartDate:     start,
+		EndDate:       start.AddDate(0, 0, 2),
+		RoomID:        roomID,
+		ReservationID: 1,
+		RestrictionID: models.RestrictionReservation,
+	})
+	restrictions = append(restrictions, models.RoomRestriction{
+		ID:            2,
+		StartDate:     start.AddDate(0, 0, 3),
+		EndDate:       start.AddDate(0, 0, 4),
+		RoomID:        roomID,
+		RestrictionID: models.RestrictionOwnerBlock,
+	})
+	return restrictions, nil
+}
+
+// InsertBlockForRoom inserts an owner block for a room on a single day
+func (m *testDBRepo) InsertBlockForRoom(ctx context.Context, id int, startDate time.Time) error {
+	// the 20th is taken, and blocking the 21st fails
+	switch startDate.Day() {
+	case 20:
+		return repository.ErrRoomUnavailable
+	case 21:
+		return errors.New("some error")
+	}
+	return nil
+}
+
+// DeleteBlockByID deletes an owner block
+func (m *testDBRepo) DeleteBlockByID(ctx context.Context, id int) error {
+	if id == 3 {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+// testAPITokens are the api tokens of the test repository, hashes of "bk_test_availability"
+// granted availability:read and "bk_test_reservations" granted every scope
+var testAPITokens = []models.APIToken{
+	{
+		ID:        1,
+		UserID:    1,
+		Name:      "Availability partner",
+		TokenHash: "24bdba4ea522fc616e2a3797d77b66906c1c2ead900813b1ad3395d8544718a7",
+		Scopes:    []string{models.ScopeReadAvailability},
+	},
+	{
+		ID:        2,
+		UserID:    1,
+		Name:      "Booking partner",
+		TokenHash: "10e925cfc23d018e9431099ef76be10821cd0c26fbc1ba78b443f10451d7a9a8",
+		Scopes:    []string{models.ScopeReadAvailability, models.ScopeWriteReservations},
+	},
+}
+
+// InsertAPIToken inserts a new api token and returns its id
+func (m *testDBRepo) InsertAPIToken(ctx context.Context, t models.APIToken) (int, error) {
+	// if the token is named fail, then fail
+	if t.Name == "fail" {
+		return 0, errors.New("test error")
+	}
+	return 1, nil
+}
+
+// GetAPITokenByHash returns the api token having the given hash
+func (m *testDBRepo) GetAPITokenByHash(ctx context.Context, hash string) (models.APIToken, error) {
+	// the tokens are found by the test hashes, and every other token does not exist
+	for _, t := range testAPITokens {
+		if t.TokenHash == hash {
+			return t, nil
+		}
+	}
+	return models.APIToken{}, sql.ErrNoRows
+}
+
+// AllAPITokens returns all api tokens
+func (m *testDBRepo) AllAPITokens(ctx context.Context) ([]models.APIToken, error) {
+	return testAPITokens, nil
+}
+
+// DeleteAPIToken deletes an api token, revoking it
+func (m *testDBRepo) DeleteAPIToken(ctx context.Context, id int) error {
+	// if the token id is 2, then fail
+	if id == 2 {
+		return errors.New("test error")
+	}
+	return nil
+}
+
+// testRatePlans are the rate plans of the test repository, charging the General's Quarters (room 2)
+// more in the summer of 2050, and even more on its Friday and Saturday nights
+var testRatePlans = []models.RatePlan{
+	{
+		ID:          1,
+		RoomID:      2,
+		Name:        "Summer",
+		StartDate:   time.Date(2050, 6, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:     time.Date(2050, 8, 31, 0, 0, 0, 0, time.UTC),
+		NightlyRate: 18000,
+		Room:        models.Room{ID: 2, RoomName: "General's Quarters", NightlyRate: 12000},
+	},
+	{
+		ID:          2,
+		RoomID:      2,
+		Name:        "Summer weekends",
+		StartDate:   time.Date(2050, 6, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:     time.Date(2050, 8, 31, 0, 0, 0, 0, time.UTC),
+		Weekdays:    []time.Weekday{time.Friday, time.Saturday},
+		NightlyRate: 20000,
+		Room:        models.Room{ID: 2, RoomName: "General's Quarters", NightlyRate: 12000},
+	},
+}
+
+// InsertRatePlan inserts a new rate plan and returns its id
+func (m *testDBRepo) InsertRatePlan(ctx context.Context, p models.RatePlan) (int, error) {
+	// if the plan is named fail, then fail
+	if p.Name == "fail" {
+		return 0, errors.New("test error")
+	}
+	return 3, nil
+}
+
+// AllRatePlans returns all rate plans, along with their room
+func (m *testDBRepo) AllRatePlans(ctx context.Context) ([]models.RatePlan, error) {
+	return testRatePlans, nil
+}
+
+// GetRatePlansByDates returns the rate plans of every room applying to some night between the
+// arrival and departure dates
+func (m *testDBRepo) GetRatePlansByDates(ctx context.Context, start, end time.Time) ([]models.RatePlan, error) {
+	// if the arrival is in 2001, then fail
+	if start.Year() == 2001 {
+		return nil, errors.New("test error")
+	}
+	return testRatePlans, nil
+}
+
+// DeleteRatePlan deletes a rate plan
+func (m *testDBRepo) DeleteRatePlan(ctx context.Context, id int) error {
+	// if the plan id is 2, then fail
+	if id == 2 {
+		return errors.New("test error")
+	}
+	return nil
+}
@@ -1,16 +1,52 @@
 package repository
 
 import (
+	"context"
+	"errors"
 	"github.com/tomdim/bookings/internal/models"
 	"time"
 )
 
+// ErrRoomUnavailable is returned when a room got booked or blocked for the requested dates
+// before the booking could be made
+var ErrRoomUnavailable = errors.New("room is not available for the requested dates")
+
 type DatabaseRepo interface {
-	AllUsers() bool
+	AllUsers(ctx context.Context) bool
+
+	Ping(ctx context.Context) error
+	MigrationVersion(ctx context.Context) (string, error)
+
+	CreateBookingTx(ctx context.Context, res models.Reservation) (int, string, error)
+	SearchAvailabilityByDatesByRoomID(ctx context.Context, start, end time.Time, roomID int) (bool, error)
+	SearchAvailabilityForAllRooms(ctx context.Context, start, end time.Time) ([]models.Room, error)
+	GetRoomByID(ctx context.Context, id int) (models.Room, error)
+
+	GetUserByID(ctx context.Context, id int) (models.User, error)
+	UpdateUser(ctx context.Context, u models.User) error
+	Authenticate(ctx context.Context, email, testPassword string) (int, string, error)
+
+	AllReservations(ctx context.Context) ([]models.Reservation, error)
+	NewReservations(ctx context.Context) ([]models.Reservation, error)
+	GetReservationByID(ctx context.Context, id int) (models.Reservation, error)
+	GetReservationByReference(ctx context.Context, reference string) (models.Reservation, error)
+	UpdateReservation(ctx context.Context, res models.Reservation) error
+	DeleteReservation(ctx context.Context, id int) error
+	CancelReservation(ctx context.Context, id int) error
+	UpdateProcessedForReservation(ctx context.Context, id, processed int) error
+
+	AllRooms(ctx context.Context) ([]models.Room, error)
+	GetRestrictionsForRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]models.RoomRestriction, error)
+	InsertBlockForRoom(ctx context.Context, id int, startDate time.Time) error
+	DeleteBlockByID(ctx context.Context, id int) error
+
+	InsertAPIToken(ctx context.Context, t models.APIToken) (int, error)
+	GetAPITokenByHash(ctx context.Context, hash string) (models.APIToken, error)
+	AllAPITokens(ctx context.Context) ([]models.APIToken, error)
+	DeleteAPIToken(ctx context.Context, id int) error
 
-	InsertReservation(res models.Reservation) (int, error)
-	InsertRoomRestriction(res models.RoomRestriction) error
-	SearchAvailabilityByDatesByRoomID(start, end time.Time, roomID int) (bool, error)
-	SearchAvailabilityForAllRooms(start, end time.Time) ([]models.Room, error)
-	GetRoomByID(id int) (models.Room, error)
+	InsertRatePlan(ctx context.Context, p models.RatePlan) (int, error)
+	AllRatePlans(ctx context.Context) ([]models.RatePlan, error)
+	GetRatePlansByDates(ctx context.Context, start, end time.Time) ([]models.RatePlan, error)
+	DeleteRatePlan(ctx context.Context, id int) error
 }
@@ -0,0 +1,92 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// the exporters spans can be sent to
+const (
+	ExporterNone   = ""
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+// ServiceName is the name the application reports its spans under
+const ServiceName = "bookings"
+
+// the attributes describing a booking, shared by the handler and repository spans
+const (
+	RoomID        = attribute.Key("bookings.room.id")
+	ReservationID = attribute.Key("bookings.reservation.id")
+	StartDate     = attribute.Key("bookings.start_date")
+	EndDate       = attribute.Key("bookings.end_date")
+	Statement     = attribute.Key("db.statement.name")
+	APITokenID    = attribute.Key("bookings.api_token.id")
+)
+
+// Dates returns the attributes for the start and end date of a stay
+func Dates(start, end time.Time) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		StartDate.String(start.Format("2006-01-02")),
+		EndDate.String(end.Format("2006-01-02")),
+	}
+}
+
+// Stay returns the attributes for a room and the dates it is booked or searched for
+func Stay(roomID int, start, end time.Time) []attribute.KeyValue {
+	return append(Dates(start, end), RoomID.Int(roomID))
+}
+
+// Setup installs the global tracer provider for the exporter, and returns a function that flushes
+// the pending spans on shutdown. The stdout exporter writes to w. With no exporter tracing stays
+// disabled and spans cost next to nothing.
+func Setup(ctx context.Context, exporter string, w io.Writer) (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+
+	var exp sdktrace.SpanExporter
+	var err error
+
+	switch exporter {
+	case ExporterNone:
+		return noop, nil
+	case ExporterStdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(w))
+	case ExporterOTLP:
+		// the endpoint and headers are read from the standard OTEL_EXPORTER_OTLP_* variables
+		exp, err = otlptracehttp.New(ctx)
+	default:
+		return noop, fmt.Errorf("unknown tracing exporter %q", exporter)
+	}
+	if err != nil {
+		return noop, fmt.Errorf("cannot create %s trace exporter: %w", exporter, err)
+	}
+
+	res, err := resource.Merge(resource.Default(),
+		resource.NewSchemaless(attribute.String("service.name", ServiceName)))
+	if err != nil {
+		return noop, fmt.Errorf("cannot create trace resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	return tp.Shutdown, nil
+}
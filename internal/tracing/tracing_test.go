@@ -0,0 +1,50 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestSetup(t *testing.T) {
+	var buf bytes.Buffer
+	flush, err := Setup(context.Background(), ExporterStdout, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, span := otel.Tracer("test").Start(context.Background(), "booking")
+	span.SetAttributes(Stay(1, start, start.AddDate(0, 0, 2))...)
+	span.End()
+
+	if err = flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	for _, s := range []string{`"Name":"booking"`, "bookings.room.id", "2050-01-03", `"Value":"bookings"`} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected exported span to contain %s, got %s", s, out)
+		}
+	}
+}
+
+func TestSetup_Exporters(t *testing.T) {
+	flush, err := Setup(context.Background(), ExporterNone, nil)
+	if err != nil {
+		t.Errorf("expected no error without an exporter, got %s", err)
+	}
+	if err = flush(context.Background()); err != nil {
+		t.Errorf("expected no error flushing without an exporter, got %s", err)
+	}
+
+	_, err = Setup(context.Background(), "jaeger", nil)
+	if err == nil {
+		t.Error("expected an error for an unknown exporter")
+	}
+}
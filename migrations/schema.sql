@@ -20,6 +20,86 @@ SET default_tablespace = '';
 
 SET default_table_access_method = heap;
 
+--
+-- Name: api_tokens; Type: TABLE; Schema: public; Owner: orfium
+--
+
+CREATE TABLE public.api_tokens (
+    id integer NOT NULL,
+    user_id integer NOT NULL,
+    name character varying(255) NOT NULL,
+    token_hash character varying(64) NOT NULL,
+    scopes character varying(255) DEFAULT ''::character varying NOT NULL,
+    created_at timestamp without time zone NOT NULL,
+    updated_at timestamp without time zone NOT NULL
+);
+
+
+ALTER TABLE public.api_tokens OWNER TO orfium;
+
+--
+-- Name: api_tokens_id_seq; Type: SEQUENCE; Schema: public; Owner: orfium
+--
+
+CREATE SEQUENCE public.api_tokens_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+ALTER TABLE public.api_tokens_id_seq OWNER TO orfium;
+
+--
+-- Name: api_tokens_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: orfium
+--
+
+ALTER SEQUENCE public.api_tokens_id_seq OWNED BY public.api_tokens.id;
+
+
+--
+-- Name: rate_plans; Type: TABLE; Schema: public; Owner: orfium
+--
+
+CREATE TABLE public.rate_plans (
+    id integer NOT NULL,
+    room_id integer NOT NULL,
+    name character varying(255) NOT NULL,
+    start_date date NOT NULL,
+    end_date date NOT NULL,
+    weekdays character varying(255) DEFAULT ''::character varying NOT NULL,
+    nightly_rate integer NOT NULL,
+    created_at timestamp without time zone NOT NULL,
+    updated_at timestamp without time zone NOT NULL
+);
+
+
+ALTER TABLE public.rate_plans OWNER TO orfium;
+
+--
+-- Name: rate_plans_id_seq; Type: SEQUENCE; Schema: public; Owner: orfium
+--
+
+CREATE SEQUENCE public.rate_plans_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+ALTER TABLE public.rate_plans_id_seq OWNER TO orfium;
+
+--
+-- Name: rate_plans_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: orfium
+--
+
+ALTER SEQUENCE public.rate_plans_id_seq OWNED BY public.rate_plans.id;
+
+
 --
 -- Name: reservations; Type: TABLE; Schema: public; Owner: orfium
 --
@@ -34,7 +114,11 @@ CREATE TABLE public.reservations (
     end_date date NOT NULL,
     room_id integer NOT NULL,
     created_at timestamp without time zone NOT NULL,
-    updated_at timestamp without time zone NOT NULL
+    updated_at timestamp without time zone NOT NULL,
+    processed integer DEFAULT 0 NOT NULL,
+    reference character varying(32) NOT NULL,
+    cancelled integer DEFAULT 0 NOT NULL,
+    api_token_id integer
 );
 
 
@@ -146,7 +230,8 @@ CREATE TABLE public.rooms (
     id integer NOT NULL,
     room_name character varying(255) DEFAULT ''::character varying NOT NULL,
     created_at timestamp without time zone NOT NULL,
-    updated_at timestamp without time zone NOT NULL
+    updated_at timestamp without time zone NOT NULL,
+    nightly_rate integer DEFAULT 0 NOT NULL
 );
 
 
@@ -225,6 +310,20 @@ ALTER TABLE public.users_id_seq OWNER TO orfium;
 ALTER SEQUENCE public.users_id_seq OWNED BY public.users.id;
 
 
+--
+-- Name: api_tokens id; Type: DEFAULT; Schema: public; Owner: orfium
+--
+
+ALTER TABLE ONLY public.api_tokens ALTER COLUMN id SET DEFAULT nextval('public.api_tokens_id_seq'::regclass);
+
+
+--
+-- Name: rate_plans id; Type: DEFAULT; Schema: public; Owner: orfium
+--
+
+ALTER TABLE ONLY public.rate_plans ALTER COLUMN id SET DEFAULT nextval('public.rate_plans_id_seq'::regclass);
+
+
 --
 -- Name: reservations id; Type: DEFAULT; Schema: public; Owner: orfium
 --
@@ -260,6 +359,22 @@ ALTER TABLE ONLY public.rooms ALTER COLUMN id SET DEFAULT nextval('public.rooms_
 ALTER TABLE ONLY public.users ALTER COLUMN id SET DEFAULT nextval('public.users_id_seq'::regclass);
 
 
+--
+-- Name: api_tokens api_tokens_pkey; Type: CONSTRAINT; Schema: public; Owner: orfium
+--
+
+ALTER TABLE ONLY public.api_tokens
+    ADD CONSTRAINT api_tokens_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: rate_plans rate_plans_pkey; Type: CONSTRAINT; Schema: public; Owner: orfium
+--
+
+ALTER TABLE ONLY public.rate_plans
+    ADD CONSTRAINT rate_plans_pkey PRIMARY KEY (id);
+
+
 --
 -- Name: reservations reservations_pkey; Type: CONSTRAINT; Schema: public; Owner: orfium
 --
@@ -300,6 +415,20 @@ ALTER TABLE ONLY public.users
     ADD CONSTRAINT users_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: api_tokens_token_hash_idx; Type: INDEX; Schema: public; Owner: orfium
+--
+
+CREATE UNIQUE INDEX api_tokens_token_hash_idx ON public.api_tokens USING btree (token_hash);
+
+
+--
+-- Name: rate_plans_room_id_start_date_end_date_idx; Type: INDEX; Schema: public; Owner: orfium
+--
+
+CREATE INDEX rate_plans_room_id_start_date_end_date_idx ON public.rate_plans USING btree (room_id, start_date, end_date);
+
+
 --
 -- Name: reservations_email_idx; Type: INDEX; Schema: public; Owner: orfium
 --
@@ -314,6 +443,13 @@ CREATE INDEX reservations_email_idx ON public.reservations USING btree (email);
 CREATE INDEX reservations_last_name_idx ON public.reservations USING btree (last_name);
 
 
+--
+-- Name: reservations_reference_idx; Type: INDEX; Schema: public; Owner: orfium
+--
+
+CREATE UNIQUE INDEX reservations_reference_idx ON public.reservations USING btree (reference);
+
+
 --
 -- Name: room_restrictions_reservation_id_idx; Type: INDEX; Schema: public; Owner: orfium
 --
@@ -349,6 +485,30 @@ CREATE UNIQUE INDEX schema_migration_version_idx ON public.schema_migration USIN
 CREATE UNIQUE INDEX users_email_idx ON public.users USING btree (email);
 
 
+--
+-- Name: api_tokens api_tokens_users_id_fk; Type: FK CONSTRAINT; Schema: public; Owner: orfium
+--
+
+ALTER TABLE ONLY public.api_tokens
+    ADD CONSTRAINT api_tokens_users_id_fk FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+
+--
+-- Name: rate_plans rate_plans_rooms_id_fk; Type: FK CONSTRAINT; Schema: public; Owner: orfium
+--
+
+ALTER TABLE ONLY public.rate_plans
+    ADD CONSTRAINT rate_plans_rooms_id_fk FOREIGN KEY (room_id) REFERENCES public.rooms(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+
+--
+-- Name: reservations reservations_api_tokens_id_fk; Type: FK CONSTRAINT; Schema: public; Owner: orfium
+--
+
+ALTER TABLE ONLY public.reservations
+    ADD CONSTRAINT reservations_api_tokens_id_fk FOREIGN KEY (api_token_id) REFERENCES public.api_tokens(id) ON UPDATE CASCADE ON DELETE SET NULL;
+
+
 --
 -- Name: reservations reservations_rooms_id_fk; Type: FK CONSTRAINT; Schema: public; Owner: orfium
 --
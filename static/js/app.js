@@ -108,4 +108,26 @@ function Prompt() {
         error: error,
         custom: custom,
     }
-}
\ No newline at end of file
+}
+
+// formatPrice returns an amount in cents as dollars, such as $1,250.00
+function formatPrice(cents) {
+    return (cents / 100).toLocaleString("en-US", {style: "currency", currency: "USD"});
+}
+
+// escapeHTML returns text escaped to be inserted into html
+function escapeHTML(text) {
+    let div = document.createElement("div");
+    div.textContent = text;
+    return div.innerHTML;
+}
+
+// quoteSummary returns the price of a stay quoted by /search-availability-json as html
+function quoteSummary(quote) {
+    if (!quote) {
+        return "";
+    }
+    let lines = quote.lines.map(line => line.nights + (line.nights === 1 ? " night" : " nights")
+        + " &times; " + formatPrice(line.rate) + (line.name ? " (" + escapeHTML(line.name) + ")" : ""));
+    return "<p>" + lines.join("<br>") + "<br><strong>Total: " + formatPrice(quote.total) + "</strong></p>";
+}